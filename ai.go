@@ -1,17 +1,79 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Errors classifying why an OpenAI call failed, for use with errors.Is.
+var (
+	// ErrOpenAIAuth means the API key was rejected; retrying will not help.
+	ErrOpenAIAuth = errors.New("OpenAI authentication failed")
+	// ErrOpenAIRateLimited means the request was throttled or the quota is used up.
+	ErrOpenAIRateLimited = errors.New("OpenAI rate limit exceeded")
+	// ErrOpenAIUnavailable means the API could not be reached, timed out or failed
+	// on its side.
+	ErrOpenAIUnavailable = errors.New("OpenAI unavailable")
+	// ErrOpenAIParse means the response did not have the expected shape.
+	ErrOpenAIParse = errors.New("OpenAI response could not be parsed")
 )
 
+// openAIStatusError classifies an unsuccessful response from the OpenAI API.
+func openAIStatusError(resp *http.Response) error {
+	data, _ := io.ReadAll(resp.Body)
+	err := fmt.Errorf("chat completion request returned status %s: %s", resp.Status, string(data))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: %v", ErrOpenAIAuth, err)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %v", ErrOpenAIRateLimited, err)
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("%w: %v", ErrOpenAIUnavailable, err)
+	}
+	return err
+}
+
+// openAIRequestError classifies a failure to get any response from the OpenAI API.
+// Cancellation by the caller is not the API's fault and is left unclassified.
+func openAIRequestError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("chat completion request failed: %w", err)
+	}
+	return fmt.Errorf("%w: chat completion request failed: %v", ErrOpenAIUnavailable, err)
+}
+
+// authFailureLogged ensures a rejected API key is reported prominently only once.
+var authFailureLogged sync.Once
+
+// logAIError logs a failed AI call prefixed with what was attempted. Authentication
+// failures are logged once as a configuration problem rather than on every call.
+func logAIError(what string, err error) {
+	if errors.Is(err, ErrOpenAIAuth) {
+		authFailureLogged.Do(func() {
+			log.Printf("ERROR: OpenAI rejected the API key; AI features will fail until OPENAI_API_KEY is fixed: %v", err)
+		})
+		return
+	}
+	log.Printf("%s: %v", what, err)
+}
+
 // chatMessage represents a message in a chat completion request or response.
 type chatMessage struct {
 	Role    string `json:"role"`
@@ -23,6 +85,7 @@ type chatCompletionRequest struct {
 	Model       string        `json:"model"`
 	Messages    []chatMessage `json:"messages"`
 	Temperature float32       `json:"temperature"`
+	Stream      bool          `json:"stream,omitempty"`
 }
 
 // chatCompletionResponse represents the response from an OpenAI chat completion.
@@ -30,8 +93,23 @@ type chatCompletionResponse struct {
 	Choices []struct {
 		Message chatMessage `json:"message"`
 	} `json:"choices"`
+	Usage chatUsage `json:"usage"`
 }
 
+// chatUsage is the token count the API reports for a chat completion.
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// isoDatePattern matches explicit ISO dates such as 2025-06-15.
+var isoDatePattern = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
+
+// numericDatePattern matches day/month dates such as 15.06.2025 or 06/15/2025,
+// capturing both leading numbers and the year.
+var numericDatePattern = regexp.MustCompile(`\b(\d{1,2})[./](\d{1,2})[./](\d{4})\b`)
+
 // extractDateKeywords scans note content for relative day mentions and explicit dates,
 // returning unique ISO-formatted date keywords.
 func extractDateKeywords(noteContent string) []string {
@@ -63,41 +141,350 @@ func extractDateKeywords(noteContent string) []string {
 		}
 	}
 	// explicit ISO date patterns
-	isoRe := regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`)
-	for _, match := range isoRe.FindAllString(noteContent, -1) {
+	for _, match := range isoDatePattern.FindAllString(noteContent, -1) {
 		dates = append(dates, match)
 	}
-	// explicit DMY date patterns (dd.mm.yyyy or dd/mm/yyyy)
-	dmyRe := regexp.MustCompile(`\b(\d{1,2})[./](\d{1,2})[./](\d{4})\b`)
-	for _, match := range dmyRe.FindAllString(noteContent, -1) {
-		norm := strings.ReplaceAll(strings.ReplaceAll(match, ".", "-"), "/", "-")
-		if t, err := time.Parse("2-1-2006", norm); err == nil {
-			dates = append(dates, t.Format("2006-01-02"))
-		} else if t2, err2 := time.Parse("02-01-2006", norm); err2 == nil {
-			dates = append(dates, t2.Format("2006-01-02"))
+	// explicit day/month dates (dd.mm.yyyy or dd/mm/yyyy, or month first per DATE_ORDER)
+	dayFirst := dateOrderDayFirst()
+	for _, m := range numericDatePattern.FindAllStringSubmatch(noteContent, -1) {
+		if d, ok := parseNumericDate(m[1], m[2], m[3], dayFirst); ok {
+			dates = append(dates, d)
 		}
 	}
-	// dedupe
+	// add coarser keywords for each date and dedupe
+	granularities := dateKeywordGranularities()
 	uniq := make([]string, 0, len(dates))
 	seen := make(map[string]struct{})
+	add := func(k string) {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			uniq = append(uniq, k)
+		}
+	}
 	for _, d := range dates {
-		if _, ok := seen[d]; !ok {
-			seen[d] = struct{}{}
-			uniq = append(uniq, d)
+		if granularities["day"] {
+			add(d)
+		}
+		t, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			continue
+		}
+		if granularities["month"] {
+			add(t.Format("2006-01"))
+		}
+		if granularities["week"] {
+			year, week := t.ISOWeek()
+			add(fmt.Sprintf("%d-W%02d", year, week))
 		}
 	}
 	return uniq
 }
 
-// extractKeywords extracts a focused list of keywords for a note.
-// It filters existing keywords and suggests new ones via the OpenAI API,
-// also including date-based keywords.
-func extractKeywords(noteContent string, existing []string) ([]string, error) {
+// parseNumericDate turns the numbers of a day/month date into an ISO date. Whether a
+// comes before b as the day is decided by dayFirst, unless only the other order gives
+// a real date, as with 13/01 read month first. Dates that exist in neither order,
+// such as 32/01 or 31/02, are rejected.
+func parseNumericDate(a, b, year string, dayFirst bool) (string, bool) {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	yr, _ := strconv.Atoi(year)
+	day, month := x, y
+	if !dayFirst {
+		day, month = y, x
+	}
+	if !validDate(yr, month, day) {
+		day, month = month, day
+		if !validDate(yr, month, day) {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", yr, month, day), true
+}
+
+// validDate reports whether day exists in month of year.
+func validDate(year, month, day int) bool {
+	if month < 1 || month > 12 || day < 1 {
+		return false
+	}
+	// time.Date normalizes overflowing days into the next month
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Day() == day
+}
+
+// dateOrderDayFirst reports whether ambiguous numeric dates such as 01/02/2025 are read
+// day first, as set by DATE_ORDER: "dmy" (the default) or "mdy".
+func dateOrderDayFirst() bool {
+	switch v := strings.ToLower(os.Getenv("DATE_ORDER")); v {
+	case "", "dmy":
+		return true
+	case "mdy":
+		return false
+	default:
+		log.Printf("Ignoring unknown DATE_ORDER %q, using dmy", v)
+		return true
+	}
+}
+
+// dateKeywordGranularities returns the kinds of date keywords to emit, read from the
+// comma-separated DATE_KEYWORD_GRANULARITIES: "day" (2025-06-15), "month" (2025-06)
+// and "week" (2025-W24, ISO week). Only full dates are emitted by default.
+func dateKeywordGranularities() map[string]bool {
+	v := os.Getenv("DATE_KEYWORD_GRANULARITIES")
+	if v == "" {
+		return map[string]bool{"day": true}
+	}
+	granularities := make(map[string]bool)
+	for _, g := range splitKeywords(v, ",") {
+		switch g = strings.ToLower(g); g {
+		case "day", "month", "week":
+			granularities[g] = true
+		default:
+			log.Printf("Ignoring unknown date keyword granularity %q", g)
+		}
+	}
+	return granularities
+}
+
+// aiEnabled reports whether an OpenAI API key is configured. It is set once at
+// startup by initAI; without it, AI calls are skipped rather than failing per request.
+var aiEnabled bool
+
+// openAISlots limits how many chat completions run at once; a call takes a slot
+// for its duration and waits while all are taken. Set up by initAI.
+var openAISlots chan struct{}
+
+// defaultKeywordTemperature is the sampling temperature of keyword extraction unless
+// OPENAI_TEMPERATURE overrides it.
+const defaultKeywordTemperature = 0.2
+
+// keywordTemperature is the sampling temperature of keyword extraction. Set up by initAI.
+var keywordTemperature float32 = defaultKeywordTemperature
+
+// initAI detects whether AI features are configured and logs once if they are not.
+func initAI() {
+	openAISlots = make(chan struct{}, envInt("OPENAI_MAX_CONCURRENT", 2))
+	if v := os.Getenv("OPENAI_TEMPERATURE"); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil || t < 0 || t > 2 {
+			log.Printf("Invalid OPENAI_TEMPERATURE %q, must be between 0 and 2; using default %g", v, defaultKeywordTemperature)
+		} else {
+			keywordTemperature = float32(t)
+		}
+	}
+	aiEnabled = os.Getenv("OPENAI_API_KEY") != ""
+	if !aiEnabled {
+		log.Printf("OPENAI_API_KEY not set; AI keyword extraction is disabled, only date keywords will be added")
+	}
+}
+
+// autoKeywords returns keywords for a note without manual keywords: its date
+// keywords, which are always included, followed by AI-extracted keywords when AI is
+// enabled. If the AI call fails, fallbackKeywords stands in for it.
+func autoKeywords(ctx context.Context, content string) []keywordLink {
+	dates := linksFrom(sourceDate, extractDateKeywords(content))
+	if !aiEnabled {
+		return dates
+	}
+	existing, err := keywordCandidates(content)
+	if err != nil {
+		log.Printf("Error querying existing keywords: %v", err)
+	}
+	ai, err := extractKeywords(ctx, content, existing)
+	if err != nil {
+		logAIError("Error extracting keywords, using word frequencies instead", err)
+		return slices.Concat(dates, linksFrom(sourceFallback, fallbackKeywords(content)))
+	}
+	return slices.Concat(dates, linksFrom(sourceAI, ai))
+}
+
+// openAIModel returns the chat model to use, configurable via OPENAI_MODEL.
+func openAIModel() string {
+	if m := os.Getenv("OPENAI_MODEL"); m != "" {
+		return m
+	}
+	return "gpt-4.1-nano"
+}
+
+// chatCompletion sends the messages to the OpenAI chat completions API and returns
+// the content of the first choice and the tokens used. The request times out after
+// OPENAI_TIMEOUT. Every call is audited, failed ones included.
+func chatCompletion(ctx context.Context, messages []chatMessage, temperature float32) (content string, usage chatUsage, err error) {
+	ctx, span := tracer.Start(ctx, "openai.chatCompletion", trace.WithAttributes(attribute.String("openai.model", openAIModel())))
+	defer func() { endSpan(span, err) }()
+	defer func() { auditOpenAICall(ctx, messages, content, usage, err) }()
+	// Bursts of notes would otherwise open as many connections and run into rate
+	// limits; the timeout only starts once a slot is free
+	select {
+	case openAISlots <- struct{}{}:
+		defer func() { <-openAISlots }()
+	case <-ctx.Done():
+		return "", chatUsage{}, openAIRequestError(ctx.Err())
+	}
+	ctx, cancel := context.WithTimeout(ctx, envDuration("OPENAI_TIMEOUT", 10*time.Second))
+	defer cancel()
+	req, err := newChatRequest(ctx, chatCompletionRequest{
+		Model:       openAIModel(),
+		Messages:    messages,
+		Temperature: temperature,
+	})
+	if err != nil {
+		return "", chatUsage{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", chatUsage{}, openAIRequestError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", chatUsage{}, openAIStatusError(resp)
+	}
+	respDataBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", chatUsage{}, openAIRequestError(err)
+	}
+	var respData chatCompletionResponse
+	if err := json.Unmarshal(respDataBytes, &respData); err != nil {
+		return "", chatUsage{}, fmt.Errorf("%w: failed to unmarshal chat completion response: %v", ErrOpenAIParse, err)
+	}
+	if len(respData.Choices) < 1 {
+		return "", respData.Usage, fmt.Errorf("%w: no choices in chat completion response", ErrOpenAIParse)
+	}
+	return respData.Choices[0].Message.Content, respData.Usage, nil
+}
+
+// chatCompletionChunk is one server-sent event of a streamed chat completion.
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// openAIChatURL is the chat completions endpoint. It is a variable so that tests can
+// point it at a stub server.
+var openAIChatURL = "https://api.openai.com/v1/chat/completions"
+
+// newChatRequest builds an authenticated request to the OpenAI chat completions API.
+func newChatRequest(ctx context.Context, body chatCompletionRequest) (*http.Request, error) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
 		return nil, fmt.Errorf("OPENAI_API_KEY not set")
 	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chat completion request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", openAIChatURL, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	// Optional billing attribution for accounts with several organizations or projects
+	if org := os.Getenv("OPENAI_ORG"); org != "" {
+		req.Header.Set("OpenAI-Organization", org)
+	}
+	if project := os.Getenv("OPENAI_PROJECT"); project != "" {
+		req.Header.Set("OpenAI-Project", project)
+	}
+	return req, nil
+}
+
+// chatCompletionStream sends the messages with streaming enabled and calls onDelta
+// with each piece of content as it arrives. Canceling ctx aborts the upstream request.
+// Like chatCompletion it waits for a slot, and the streamed response is audited once
+// the stream ends. OPENAI_TIMEOUT only applies until the response headers arrive.
+func chatCompletionStream(ctx context.Context, messages []chatMessage, temperature float32, onDelta func(string) error) (err error) {
+	ctx, span := tracer.Start(ctx, "openai.chatCompletionStream", trace.WithAttributes(attribute.String("openai.model", openAIModel())))
+	defer func() { endSpan(span, err) }()
+	select {
+	case openAISlots <- struct{}{}:
+		defer func() { <-openAISlots }()
+	case <-ctx.Done():
+		return openAIRequestError(ctx.Err())
+	}
+	// Streamed responses carry no token usage unless asked for, so none is logged
+	var response strings.Builder
+	defer func() { auditOpenAICall(ctx, messages, response.String(), chatUsage{}, err) }()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := newChatRequest(ctx, chatCompletionRequest{
+		Model:       openAIModel(),
+		Messages:    messages,
+		Temperature: temperature,
+		Stream:      true,
+	})
+	if err != nil {
+		return err
+	}
 
+	// A summary may take longer to stream than OPENAI_TIMEOUT, so the timer is stopped
+	// once the response starts; from then on only the client going away ends it early
+	timeout := envDuration("OPENAI_TIMEOUT", 10*time.Second)
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := http.DefaultClient.Do(req)
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("%w: no response within %v", ErrOpenAIUnavailable, timeout)
+	}
+	if err != nil {
+		return openAIRequestError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return openAIStatusError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return nil
+		}
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("%w: failed to unmarshal chat completion chunk: %v", ErrOpenAIParse, err)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			response.WriteString(chunk.Choices[0].Delta.Content)
+			if err := onDelta(chunk.Choices[0].Delta.Content); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return openAIRequestError(err)
+	}
+	return fmt.Errorf("%w: chat completion stream ended without [DONE]", ErrOpenAIUnavailable)
+}
+
+// promptContent returns note content as it is sent to the model. Content longer than
+// OPENAI_MAX_NOTE_CHARS characters keeps its beginning and end, where the gist of a
+// note usually is, and the middle is replaced by a marker.
+func promptContent(content string) string {
+	limit := envInt("OPENAI_MAX_NOTE_CHARS", 8000)
+	runes := []rune(content)
+	if len(runes) <= limit {
+		return content
+	}
+	head, tail := limit*3/4, limit/4
+	log.Printf("Note content of %d characters truncated to %d for the prompt", len(runes), limit)
+	return fmt.Sprintf("%s\n[... %d characters omitted ...]\n%s",
+		string(runes[:head]), len(runes)-head-tail, string(runes[len(runes)-tail:]))
+}
+
+// extractKeywords extracts a focused list of keywords for a note.
+// It filters existing keywords and suggests new ones via the OpenAI API.
+// Date keywords found without the API are added separately by autoKeywords.
+func extractKeywords(ctx context.Context, noteContent string, existing []string) (_ []string, err error) {
+	ctx, span := tracer.Start(ctx, "extractKeywords", trace.WithAttributes(attribute.Int("keywords.existing", len(existing))))
+	defer func() { endSpan(span, err) }()
 	now := time.Now()
 	today := now.Format("2006-01-02")
 	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
@@ -125,53 +512,42 @@ func extractKeywords(noteContent string, existing []string) ([]string, error) {
 		exBuf.Write(data)
 		exBuf.WriteString("\n\n")
 	}
-	systemPrompt := fmt.Sprintf(`%sYou are an assistant that extracts a focused list of keywords for a note. Most of the provided existing keywords are from a broad, assorted collection and are unlikely to be relevant. Include only those existing keywords that are entirely appropriate for this note, and suggest any new relevant keywords. For any dates or day mentions in the note (e.g., "i dag", "i går", "i morgen", or weekday names like "mandag", "tirsdag", etc.), add corresponding date keywords in ISO format. Given the note content and a list of existing keywords, output only valid JSON with a single top-level key "keywords" containing an array of strings. Do not include any additional text or explanation. Today's date is %s.`, exBuf.String(), today)
-	existingJSON, err := json.Marshal(existing)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal existing keywords: %v", err)
+	systemPrompt := fmt.Sprintf(`%sYou are an assistant that extracts a focused list of keywords for a note. Most of the provided existing keywords are from a broad, assorted collection and are unlikely to be relevant. Include only those existing keywords that are entirely appropriate for this note, and suggest any new relevant keywords. The existing keywords are listed with the most used first; when an existing keyword fits, reuse it instead of suggesting a near-duplicate such as another spelling or inflection. For any dates or day mentions in the note (e.g., "i dag", "i går", "i morgen", or weekday names like "mandag", "tirsdag", etc.), add corresponding date keywords in ISO format. Today's date is %s.`, exBuf.String(), today)
+	// Tell the model the language rather than letting it guess from short notes
+	if lang := os.Getenv("NOTES_LANGUAGE"); lang != "" {
+		systemPrompt += fmt.Sprintf(" The note is written in %s.", lang)
 	}
-	userPrompt := fmt.Sprintf("Existing keywords: %s\nNote content:\n%s\nRemember: most existing keywords are not relevant unless they are completely appropriate for this note. Only include existing keywords that are entirely appropriate, and suggest any new relevant keywords.", existingJSON, noteContent)
-
-	reqBody := chatCompletionRequest{
-		Model:       "gpt-4.1-nano",
-		Messages:    []chatMessage{{Role: "system", Content: systemPrompt}, {Role: "user", Content: userPrompt}},
-		Temperature: 0.2,
+	if extra := strings.TrimSpace(os.Getenv("OPENAI_EXTRA_INSTRUCTIONS")); extra != "" {
+		systemPrompt += " " + extra
 	}
-	bodyBytes, err := json.Marshal(reqBody)
+	// The output format comes last so that extra instructions cannot override it
+	systemPrompt += ` Given the note content and a list of existing keywords, output only valid JSON with a single top-level key "keywords" containing an array of strings. Do not include any additional text or explanation.`
+	existingJSON, err := json.Marshal(existing)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal chat completion request: %v", err)
+		return nil, fmt.Errorf("failed to marshal existing keywords: %v", err)
 	}
+	userPrompt := fmt.Sprintf("Existing keywords (most used first): %s\nNote content:\n%s\nRemember: most existing keywords are not relevant unless they are completely appropriate for this note. Only include existing keywords that are entirely appropriate, and suggest any new relevant keywords.", existingJSON, promptContent(noteContent))
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(bodyBytes))
+	messages := []chatMessage{{Role: "system", Content: systemPrompt}, {Role: "user", Content: userPrompt}}
+	raw, _, err := chatCompletion(ctx, messages, keywordTemperature)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("chat completion request failed: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		data, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("chat completion request returned status %s: %s", resp.Status, string(data))
-	}
-	respDataBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read chat completion response: %v", err)
-	}
-	var respData chatCompletionResponse
-	if err := json.Unmarshal(respDataBytes, &respData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal chat completion response: %v", err)
+	clean := jsonObject(raw)
+	var parsed struct {
+		Keywords []string `json:"keywords"`
 	}
-	if len(respData.Choices) < 1 {
-		return nil, fmt.Errorf("no choices in chat completion response")
+	if err := json.Unmarshal([]byte(clean), &parsed); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse keywords JSON %q: %v", ErrOpenAIParse, clean, err)
 	}
 
-	raw := respData.Choices[0].Message.Content
+	return parsed.Keywords, nil
+}
+
+// jsonObject extracts the JSON object from a model reply, dropping code fences and any
+// text around it.
+func jsonObject(raw string) string {
 	clean := strings.TrimSpace(raw)
 	if strings.HasPrefix(clean, "```") {
 		parts := strings.SplitN(clean, "\n", 2)
@@ -186,25 +562,87 @@ func extractKeywords(noteContent string, existing []string) ([]string, error) {
 			clean = clean[start : end+1]
 		}
 	}
+	return clean
+}
+
+// keywordGroup is a set of keywords with the same meaning, proposed to be merged into
+// Target. Pattern matches the other keywords for use with /keywords/merge-by-pattern.
+type keywordGroup struct {
+	Target   string   `json:"target"`
+	Keywords []string `json:"keywords"`
+	Pattern  string   `json:"pattern"`
+}
+
+// groupSynonymKeywords asks the model which of the given keywords mean the same thing.
+// Only names from the list are returned, and only groups of at least two keywords.
+func groupSynonymKeywords(ctx context.Context, names []string) ([]keywordGroup, error) {
+	systemPrompt := `You are an assistant that tidies a collection of note keywords. Given a JSON array of keywords, find groups of keywords that mean the same thing, such as translations, spelling variants, inflections or a more specific form of the same word. Leave keywords with different meanings alone; it is fine to find no groups. For each group, pick the keyword to keep as "target", which must be one of the group. Output only valid JSON with a single top-level key "groups" containing an array of objects with the keys "target" and "keywords" (an array of strings including the target). Do not include any additional text or explanation.`
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keywords: %v", err)
+	}
+	raw, _, err := chatCompletion(ctx, []chatMessage{{Role: "system", Content: systemPrompt}, {Role: "user", Content: string(namesJSON)}}, 0)
+	if err != nil {
+		return nil, err
+	}
+	clean := jsonObject(raw)
 	var parsed struct {
-		Keywords []string `json:"keywords"`
+		Groups []keywordGroup `json:"groups"`
 	}
 	if err := json.Unmarshal([]byte(clean), &parsed); err != nil {
-		return nil, fmt.Errorf("failed to parse keywords JSON %q: %v", clean, err)
+		return nil, fmt.Errorf("%w: failed to parse keyword groups JSON %q: %v", ErrOpenAIParse, clean, err)
 	}
 
-	keywords := parsed.Keywords
-	for _, d := range extractDateKeywords(noteContent) {
-		found := false
-		for _, k := range keywords {
-			if k == d {
-				found = true
-				break
+	// The model may invent keywords or repeat one in several groups; keep the first use
+	// of each existing keyword
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	groups := []keywordGroup{}
+	for _, g := range parsed.Groups {
+		if !known[g.Target] {
+			continue
+		}
+		keywords := []string{g.Target}
+		var quoted []string
+		for _, name := range g.Keywords {
+			if known[name] && name != g.Target {
+				known[name] = false
+				keywords = append(keywords, name)
+				quoted = append(quoted, regexp.QuoteMeta(name))
 			}
 		}
-		if !found {
-			keywords = append(keywords, d)
+		if len(quoted) == 0 {
+			continue
 		}
+		known[g.Target] = false
+		groups = append(groups, keywordGroup{
+			Target:   g.Target,
+			Keywords: keywords,
+			Pattern:  "^(" + strings.Join(quoted, "|") + ")$",
+		})
+	}
+	return groups, nil
+}
+
+// suggestTitle asks the model for a short title summarizing the note content.
+func suggestTitle(ctx context.Context, noteContent string) (string, error) {
+	systemPrompt := "You are an assistant that writes titles for notes. Given the note content, reply with a single short title (at most eight words) in the same language as the note. Output only the title, without quotes or any additional text."
+	raw, _, err := chatCompletion(ctx, []chatMessage{{Role: "system", Content: systemPrompt}, {Role: "user", Content: promptContent(noteContent)}}, 0.2)
+	if err != nil {
+		return "", err
+	}
+	title := strings.Trim(strings.TrimSpace(raw), "\"'")
+	if title == "" {
+		return "", fmt.Errorf("%w: empty title in chat completion response", ErrOpenAIParse)
 	}
-	return keywords, nil
+	return title, nil
+}
+
+// streamSummary asks the model for a short summary of the note content and passes
+// it to onDelta piece by piece as it is generated.
+func streamSummary(ctx context.Context, noteContent string, onDelta func(string) error) error {
+	systemPrompt := "You are an assistant that summarizes notes. Given the note content, reply with a summary of at most three sentences in the same language as the note. Output only the summary."
+	return chatCompletionStream(ctx, []chatMessage{{Role: "system", Content: systemPrompt}, {Role: "user", Content: promptContent(noteContent)}}, 0.2, onDelta)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractDateKeywordsGranularities(t *testing.T) {
+	tests := []struct {
+		granularities, content string
+		want                   []string
+	}{
+		{"", "due 2025-06-15", []string{"2025-06-15"}},
+		{"day,month,week", "due 2025-06-15", []string{"2025-06-15", "2025-06", "2025-W24"}},
+		{"month", "due 2025-06-15 and 2025-06-20", []string{"2025-06"}},
+		// ISO weeks around the turn of the year
+		{"week", "2024-12-30", []string{"2025-W01"}},
+		{"week", "2025-12-28", []string{"2025-W52"}},
+		{"week", "2025-12-29", []string{"2026-W01"}},
+		{"week", "2021-01-03", []string{"2020-W53"}},
+		{"week", "2021-01-04", []string{"2021-W01"}},
+		{"week", "2026-12-31", []string{"2026-W53"}},
+		{"week", "2027-01-01", []string{"2026-W53"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularities+" "+tt.content, func(t *testing.T) {
+			t.Setenv("DATE_KEYWORD_GRANULARITIES", tt.granularities)
+			if got := extractDateKeywords(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractDateKeywords(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNumericDate(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		dayFirst bool
+		want     string
+		ok       bool
+	}{
+		// 13/01 only exists day first, 01/13 only month first
+		{"13", "01", true, "2025-01-13", true},
+		{"13", "01", false, "2025-01-13", true},
+		{"01", "13", true, "2025-01-13", true},
+		{"01", "13", false, "2025-01-13", true},
+		// 31/02 exists in neither order
+		{"31", "02", true, "", false},
+		{"31", "02", false, "", false},
+		{"32", "01", true, "", false},
+		// Ambiguous dates follow the configured order
+		{"01", "02", true, "2025-02-01", true},
+		{"01", "02", false, "2025-01-02", true},
+	}
+	for _, tt := range tests {
+		got, ok := parseNumericDate(tt.a, tt.b, "2025", tt.dayFirst)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseNumericDate(%s, %s, dayFirst=%v) = %q, %v, want %q, %v", tt.a, tt.b, tt.dayFirst, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExtractDateKeywordsDateOrder(t *testing.T) {
+	t.Setenv("DATE_KEYWORD_GRANULARITIES", "")
+	tests := []struct {
+		order, content string
+		want           []string
+	}{
+		{"", "13/01/2025", []string{"2025-01-13"}},
+		{"dmy", "01/13/2025", []string{"2025-01-13"}},
+		{"mdy", "13.01.2025", []string{"2025-01-13"}},
+		{"dmy", "31/02/2025", []string{}},
+		{"mdy", "02/31/2025", []string{}},
+		{"dmy", "01/02/2025", []string{"2025-02-01"}},
+		{"mdy", "01/02/2025", []string{"2025-01-02"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order+" "+tt.content, func(t *testing.T) {
+			t.Setenv("DATE_ORDER", tt.order)
+			if got := extractDateKeywords(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractDateKeywords(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatCompletionStreamAudit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, piece := range []string{"Short ", "summary."} {
+			fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %q}}]}\n\n", piece)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	previous := openAIChatURL
+	openAIChatURL = srv.URL
+	t.Cleanup(func() { openAIChatURL = previous })
+	t.Setenv("OPENAI_API_KEY", "test")
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("OPENAI_AUDIT_LOG", auditLog)
+	initAI()
+	t.Cleanup(func() { aiEnabled = false })
+
+	var streamed string
+	err := streamSummary(context.Background(), "note", func(delta string) error {
+		streamed += delta
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamSummary: %v", err)
+	}
+	if len(openAISlots) != 0 {
+		t.Errorf("%d OpenAI slots still taken after the stream ended", len(openAISlots))
+	}
+	line, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Response != streamed || streamed != "Short summary." {
+		t.Errorf("audited response %q, streamed %q, want %q", entry.Response, streamed, "Short summary.")
+	}
+}
+
+func TestChatCompletionAuditsEveryCaller(t *testing.T) {
+	stubOpenAI(t, `{"keywords": ["groceries"], "groups": []}`)
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("OPENAI_AUDIT_LOG", auditLog)
+
+	ctx := withAuditNoteID(context.Background(), "42")
+	if _, err := extractKeywords(ctx, "Buy milk", nil); err != nil {
+		t.Fatalf("extractKeywords: %v", err)
+	}
+	if _, err := suggestTitle(ctx, "Buy milk"); err != nil {
+		t.Fatalf("suggestTitle: %v", err)
+	}
+	if _, err := groupSynonymKeywords(context.Background(), []string{"milk", "melk"}); err != nil {
+		t.Fatalf("groupSynonymKeywords: %v", err)
+	}
+
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var noteIDs []string
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		noteIDs = append(noteIDs, entry.NoteID)
+	}
+	if want := []string{"42", "42", ""}; !reflect.DeepEqual(noteIDs, want) {
+		t.Errorf("audited note IDs = %q, want %q", noteIDs, want)
+	}
+}
+
+func TestChatCompletionStreamTimeout(t *testing.T) {
+	var headerDelay, streamDelay time.Duration
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pause := func(d time.Duration) {
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+			}
+		}
+		pause(headerDelay)
+		fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \"Short \"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		pause(streamDelay)
+		fmt.Fprint(w, "data: {\"choices\": [{\"delta\": {\"content\": \"summary.\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	previous := openAIChatURL
+	openAIChatURL = srv.URL
+	t.Cleanup(func() { openAIChatURL = previous })
+	t.Setenv("OPENAI_API_KEY", "test")
+	t.Setenv("OPENAI_TIMEOUT", "50ms")
+	initAI()
+	t.Cleanup(func() { aiEnabled = false })
+
+	stream := func() (string, error) {
+		var streamed string
+		err := chatCompletionStream(context.Background(), nil, 0, func(delta string) error {
+			streamed += delta
+			return nil
+		})
+		return streamed, err
+	}
+
+	// A stream that outlasts the timeout after it started is not cut off
+	streamDelay = 150 * time.Millisecond
+	if streamed, err := stream(); err != nil || streamed != "Short summary." {
+		t.Errorf("slow stream = %q, %v; want %q", streamed, err, "Short summary.")
+	}
+
+	headerDelay, streamDelay = 150*time.Millisecond, 0
+	if _, err := stream(); !errors.Is(err, ErrOpenAIUnavailable) {
+		t.Errorf("slow response error = %v, want %v", err, ErrOpenAIUnavailable)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// aiJob is a unit of background AI work, such as extracting keywords for a note.
+// Its context is canceled if the queue shuts down before or while it runs.
+type aiJob struct {
+	name string
+	ctx  context.Context
+	run  func(ctx context.Context) error
+}
+
+// aiQueue runs AI jobs on a fixed number of workers. A shared ticker spaces out job
+// starts so that all workers together respect a global rate limit.
+type aiQueue struct {
+	jobs    chan aiJob
+	workers int
+	every   time.Duration
+	wg      sync.WaitGroup
+}
+
+// aiJobs is the queue used for background AI work; it is created in main.
+var aiJobs *aiQueue
+
+// newAIQueue creates a queue holding up to size pending jobs, processed by the given
+// number of workers, starting at most perMinute jobs per minute.
+func newAIQueue(workers, size, perMinute int) *aiQueue {
+	return &aiQueue{
+		jobs:    make(chan aiJob, size),
+		workers: workers,
+		every:   time.Minute / time.Duration(perMinute),
+	}
+}
+
+// start launches the workers. They stop when ctx is canceled; jobs still queued at
+// that point are dropped and the running ones see their context canceled.
+func (q *aiQueue) start(ctx context.Context) {
+	ticker := time.NewTicker(q.every)
+	for range q.workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q.jobs:
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+					q.run(ctx, job)
+				}
+			}
+		}()
+	}
+	go func() {
+		q.wg.Wait()
+		ticker.Stop()
+		if n := len(q.jobs); n > 0 {
+			log.Printf("AI queue stopped with %d job(s) not run", n)
+		}
+	}()
+}
+
+// run executes a single job with a context that is also canceled when the queue stops.
+func (q *aiQueue) run(queueCtx context.Context, job aiJob) {
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+	stop := context.AfterFunc(queueCtx, cancel)
+	defer stop()
+
+	if err := job.run(ctx); err != nil {
+		logAIError(fmt.Sprintf("AI job %q failed", job.name), err)
+	}
+}
+
+// enqueue adds a job without blocking. If the queue is full the job is dropped and
+// false is returned.
+func (q *aiQueue) enqueue(job aiJob) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		log.Printf("AI queue full, dropping job %q", job.name)
+		return false
+	}
+}
+
+// wait blocks until all workers have stopped.
+func (q *aiQueue) wait() {
+	q.wg.Wait()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditMu serializes appends to the OpenAI audit log, so concurrent calls cannot
+// interleave their lines.
+var auditMu sync.Mutex
+
+// auditNoteIDKey is the context key under which withAuditNoteID stores a note ID.
+type auditNoteIDKey struct{}
+
+// withAuditNoteID records in ctx which note an OpenAI call is made for, so the audit
+// log can name it. Notes that are not saved yet have no ID to record.
+func withAuditNoteID(ctx context.Context, noteID string) context.Context {
+	return context.WithValue(ctx, auditNoteIDKey{}, noteID)
+}
+
+// auditEntry is one line of the OpenAI audit log.
+type auditEntry struct {
+	Time     time.Time     `json:"time"`
+	NoteID   string        `json:"noteId,omitempty"`
+	Model    string        `json:"model"`
+	Prompt   []chatMessage `json:"prompt"`
+	Response string        `json:"response"`
+	Usage    chatUsage     `json:"usage"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// auditOpenAICall appends a JSON line describing an OpenAI call to OPENAI_AUDIT_LOG,
+// if it is set. The prompt and response are logged in full, note content included.
+// Failing to write is logged but does not fail the call.
+func auditOpenAICall(ctx context.Context, prompt []chatMessage, response string, usage chatUsage, callErr error) {
+	path := os.Getenv("OPENAI_AUDIT_LOG")
+	if path == "" {
+		return
+	}
+	entry := auditEntry{
+		Time:     time.Now(),
+		Model:    openAIModel(),
+		Prompt:   prompt,
+		Response: response,
+		Usage:    usage,
+	}
+	entry.NoteID, _ = ctx.Value(auditNoteIDKey{}).(string)
+	if callErr != nil {
+		entry.Error = callErr.Error()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding OpenAI audit entry: %v", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Error opening OpenAI audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing OpenAI audit log: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupDatabase writes a consistent copy of the database into dir with VACUUM INTO,
+// which reads a snapshot while the server keeps running, and returns the file's path.
+func backupDatabase(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	path := filepath.Join(dir, "notes-"+time.Now().Format("20060102-150405")+".db")
+	// VACUUM INTO refuses to overwrite, so two backups in the same second fail
+	// instead of clobbering each other
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return "", fmt.Errorf("failed to write backup %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// backupHandler writes a database backup to BACKUP_DIR and returns its path as JSON.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	path, err := backupDatabase(os.Getenv("BACKUP_DIR"))
+	if err != nil {
+		log.Printf("Error backing up database: %v", err)
+		http.Error(w, "Error writing backup", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Database backed up to %s", path)
+	writeJSON(w, http.StatusOK, struct {
+		Path string `json:"path"`
+	}{path})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// blockPattern is a named pattern of content that may not be saved.
+type blockPattern struct {
+	Name string
+	Re   *regexp.Regexp
+}
+
+// blocklist holds the patterns read from BLOCKLIST_FILE; it is empty when unset.
+var blocklist []blockPattern
+
+// initBlocklist reads BLOCKLIST_FILE, if set. Each line holds a regular expression,
+// optionally preceded by a name and a tab; lines starting with # are comments.
+// Unnamed patterns are named after their line number.
+func initBlocklist() {
+	path := os.Getenv("BLOCKLIST_FILE")
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open BLOCKLIST_FILE: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, expr, ok := strings.Cut(line, "\t")
+		if !ok {
+			name, expr = fmt.Sprintf("line %d", n), line
+		}
+		re, err := regexp.Compile(strings.TrimSpace(expr))
+		if err != nil {
+			log.Fatalf("Invalid pattern on line %d of BLOCKLIST_FILE: %v", n, err)
+		}
+		blocklist = append(blocklist, blockPattern{Name: strings.TrimSpace(name), Re: re})
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Could not read BLOCKLIST_FILE: %v", err)
+	}
+	log.Printf("Loaded %d blocklist patterns", len(blocklist))
+}
+
+// blockedBy returns the name of the first blocklist pattern content matches, or ""
+// if it matches none.
+func blockedBy(content string) string {
+	for _, p := range blocklist {
+		if p.Re.MatchString(content) {
+			return p.Name
+		}
+	}
+	return ""
+}
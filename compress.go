@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// compressMinBytes is the content size below which compression is not attempted,
+// since gzip overhead outweighs the savings for short notes.
+const compressMinBytes = 1024
+
+// compressContent gzip-compresses note content.
+func compressContent(content string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, content); err != nil {
+		return nil, fmt.Errorf("failed to compress note content: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress note content: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressContent reverses compressContent.
+func decompressContent(packed []byte) (string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress note content: %v", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress note content: %v", err)
+	}
+	return string(data), nil
+}
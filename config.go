@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a duration (e.g. "10m") from the named environment variable,
+// falling back to def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using default %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the named environment variable, falling back
+// to def when it is unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using default %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envBool reports whether the named environment variable is set to a true value
+// such as "1" or "true".
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
+// debugf logs like log.Printf, but only when DEBUG is set, for detail that is noise
+// in normal operation.
+func debugf(format string, args ...any) {
+	if envBool("DEBUG") {
+		log.Printf("DEBUG: "+format, args...)
+	}
+}
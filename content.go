@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// excessBlankLines matches runs of three or more blank lines.
+var excessBlankLines = regexp.MustCompile(`\n(?:[ \t]*\n){3,}`)
+
+// normalizeContent tidies note content before it is saved: CRLF line endings become
+// LF, control characters other than tab and newline are removed, leading and trailing
+// whitespace is trimmed, and runs of three or more blank lines are collapsed to two.
+// Everything else is left as typed.
+func normalizeContent(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = stripControlChars(content)
+	content = strings.TrimSpace(content)
+	return excessBlankLines.ReplaceAllString(content, "\n\n\n")
+}
+
+// stripControlChars removes control characters such as null bytes, which pasted text
+// sometimes carries, keeping tabs and newlines. It logs how many were removed.
+func stripControlChars(content string) string {
+	removed := 0
+	stripped := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' {
+			removed++
+			return -1
+		}
+		return r
+	}, content)
+	if removed > 0 {
+		log.Printf("Removed %d control characters from note content", removed)
+	}
+	return stripped
+}
+
+// encodeContent prepares note content for storage: it is gzip-compressed when
+// COMPRESS_CONTENT is set and the note is large enough to benefit, then encrypted
+// when ENCRYPTION_KEY is set. Compressed content is stored as a BLOB and everything
+// else as TEXT; the storage type is what marks a row as compressed, so there is no
+// separate flag that could disagree with the data.
+func encodeContent(content string) (stored any, err error) {
+	if envBool("COMPRESS_CONTENT") && len(content) >= compressMinBytes {
+		if packed, err := compressContent(content); err != nil {
+			return nil, err
+		} else if len(packed) < len(content) {
+			enc, err := encryptContent(string(packed))
+			if err != nil {
+				return nil, err
+			}
+			return []byte(enc), nil
+		}
+	}
+	return encryptContent(content)
+}
+
+// decodedContent is a scan destination that turns stored note content back into
+// text, decrypting and decompressing it as needed.
+type decodedContent struct {
+	dst *string
+}
+
+// decoded wraps dst so that scanning a content column into it decodes the value.
+func decoded(dst *string) sql.Scanner {
+	return decodedContent{dst: dst}
+}
+
+func (d decodedContent) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		content, err := decryptContent(v)
+		if err != nil {
+			return err
+		}
+		*d.dst = content
+	case []byte:
+		// Only compressed content is stored as a BLOB
+		packed, err := decryptContent(string(v))
+		if err != nil {
+			return err
+		}
+		content, err := decompressContent([]byte(packed))
+		if err != nil {
+			return err
+		}
+		*d.dst = content
+	default:
+		return fmt.Errorf("unexpected note content type %T", src)
+	}
+	return nil
+}
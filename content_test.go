@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"crlf", "one\r\ntwo\r\n", "one\ntwo"},
+		{"trim", "\n\n  text \t\n", "text"},
+		{"two blank lines kept", "a\n\n\nb", "a\n\n\nb"},
+		{"three blank lines collapsed", "a\n\n\n\nb", "a\n\n\nb"},
+		{"many blank lines collapsed", "a\n\n\n\n\n\n\nb", "a\n\n\nb"},
+		{"whitespace-only lines count as blank", "a\n \n\t\n  \n\nb", "a\n\n\nb"},
+		{"crlf blank lines collapsed", "a\r\n\r\n\r\n\r\n\r\nb", "a\n\n\nb"},
+		{"interior spacing kept", "a  b\n\tindented", "a  b\n\tindented"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeContent(tt.in); got != tt.want {
+				t.Errorf("normalizeContent(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripControlChars(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"null byte", "before\x00after", "beforeafter"},
+		{"other control characters", "a\x01b\x1bc\x7fd\u0085e", "abcde"},
+		{"lone carriage return", "one\rtwo", "onetwo"},
+		{"tab and newline kept", "col1\tcol2\nline2", "col1\tcol2\nline2"},
+		{"unicode text kept", "blåbær – ☕", "blåbær – ☕"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripControlChars(tt.in); got != tt.want {
+				t.Errorf("stripControlChars(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeContentRoundTrip(t *testing.T) {
+	t.Setenv("COMPRESS_CONTENT", "1")
+	long := strings.Repeat("a line that compresses well\n", 100)
+	for _, content := range []string{"short note", long} {
+		stored, err := encodeContent(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The storage type is what marks compressed content
+		if _, isBlob := stored.([]byte); isBlob != (content == long) {
+			t.Errorf("encodeContent of %d bytes stored as %T", len(content), stored)
+		}
+		var got string
+		if err := decoded(&got).Scan(stored); err != nil {
+			t.Fatal(err)
+		}
+		if got != content {
+			t.Errorf("round trip of %d bytes returned %d bytes", len(content), len(got))
+		}
+	}
+}
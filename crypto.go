@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks note content stored encrypted, so plaintext rows written
+// before ENCRYPTION_KEY was set can still be read.
+const encryptedPrefix = "enc:v1:"
+
+// contentCipher encrypts note content at rest; nil when ENCRYPTION_KEY is unset.
+var contentCipher cipher.AEAD
+
+// initEncryption sets up AES-GCM from ENCRYPTION_KEY, a base64-encoded 32-byte key.
+func initEncryption() {
+	v := os.Getenv("ENCRYPTION_KEY")
+	if v == "" {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != 32 {
+		log.Fatalf("ENCRYPTION_KEY must be 32 bytes encoded as base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Could not create cipher: %v", err)
+	}
+	contentCipher, err = cipher.NewGCM(block)
+	if err != nil {
+		log.Fatalf("Could not create cipher: %v", err)
+	}
+}
+
+// encryptContent returns note content as it should be stored, encrypted when
+// ENCRYPTION_KEY is set and unchanged otherwise.
+func encryptContent(content string) (string, error) {
+	if contentCipher == nil {
+		return content, nil
+	}
+	nonce := make([]byte, contentCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := contentCipher.Seal(nonce, nonce, []byte(content), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptContent reverses encryptContent. Content without the encrypted prefix is
+// returned as is.
+func decryptContent(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	if contentCipher == nil {
+		return "", fmt.Errorf("note content is encrypted but ENCRYPTION_KEY is not set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil || len(sealed) < contentCipher.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted note content")
+	}
+	nonce, ciphertext := sealed[:contentCipher.NonceSize()], sealed[contentCipher.NonceSize():]
+	plain, err := contentCipher.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt note content: %v", err)
+	}
+	return string(plain), nil
+}
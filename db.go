@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -11,8 +13,15 @@ var db *sql.DB
 
 // initDB initializes the SQLite database and creates necessary tables.
 func initDB() {
+	// Wait for locks held by concurrent writers instead of failing with SQLITE_BUSY.
+	// Transactions take the write lock as soon as they begin: a deferred transaction
+	// that reads first cannot wait for it later, since two of them upgrading at once
+	// deadlock and one fails immediately whatever the timeout.
+	busyTimeout := envDuration("SQLITE_BUSY_TIMEOUT", 5*time.Second)
+	dsn := fmt.Sprintf("notes.db?_busy_timeout=%d&_txlock=immediate", busyTimeout.Milliseconds())
+
 	var err error
-	db, err = sql.Open("sqlite3", "notes.db")
+	db, err = sql.Open("sqlite3", dsn)
 	if err != nil {
 		log.Fatalf("Could not open database: %v", err)
 	}
@@ -21,12 +30,23 @@ func initDB() {
 		`CREATE TABLE IF NOT EXISTS notes(
     id TEXT PRIMARY KEY,
     content TEXT NOT NULL,
-    created_at DATETIME NOT NULL
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME,
+    locked BOOLEAN NOT NULL DEFAULT 0,
+    share_token TEXT,
+    slug TEXT,
+    starred BOOLEAN NOT NULL DEFAULT 0,
+    draft TEXT,
+    bumped_at DATETIME
 )`,
 	)
 	if err != nil {
 		log.Fatalf("Could not create notes table: %v", err)
 	}
+	// Note lists are ordered by creation time; the index saves sorting every note
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_notes_created_at ON notes(created_at)"); err != nil {
+		log.Fatalf("Could not create created_at index: %v", err)
+	}
 
 	// Keyword tables
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS keywords (
@@ -40,6 +60,7 @@ func initDB() {
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS note_keywords (
     note_id TEXT NOT NULL,
     keyword_id INTEGER NOT NULL,
+    source TEXT NOT NULL DEFAULT 'unknown',
     PRIMARY KEY (note_id, keyword_id),
     FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE,
     FOREIGN KEY (keyword_id) REFERENCES keywords(id) ON DELETE CASCADE
@@ -47,4 +68,106 @@ func initDB() {
 	if err != nil {
 		log.Fatalf("Could not create note_keywords table: %v", err)
 	}
+	// The primary key starts with note_id, so lookups by keyword need their own index
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_note_keywords_keyword_id ON note_keywords(keyword_id)"); err != nil {
+		log.Fatalf("Could not create note_keywords keyword index: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    note_id TEXT NOT NULL,
+    redirect TEXT,
+    created_at DATETIME NOT NULL
+)`)
+	if err != nil {
+		log.Fatalf("Could not create idempotency_keys table: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    data TEXT NOT NULL,
+    last_seen DATETIME NOT NULL
+)`)
+	if err != nil {
+		log.Fatalf("Could not create sessions table: %v", err)
+	}
+
+	// AI keywords removed by hand, for the acceptance rate on /stats
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS keyword_removals (
+    note_id TEXT NOT NULL,
+    keyword TEXT NOT NULL,
+    source TEXT NOT NULL,
+    removed_at DATETIME NOT NULL
+)`)
+	if err != nil {
+		log.Fatalf("Could not create keyword_removals table: %v", err)
+	}
+
+	if err := addColumnIfMissing("notes", "expires_at", "DATETIME"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "locked", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "share_token", "TEXT"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_share_token ON notes(share_token)"); err != nil {
+		log.Fatalf("Could not create share token index: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "slug", "TEXT"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_slug ON notes(slug)"); err != nil {
+		log.Fatalf("Could not create slug index: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "starred", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "draft", "TEXT"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if err := addColumnIfMissing("notes", "bumped_at", "DATETIME"); err != nil {
+		log.Fatalf("Could not migrate notes table: %v", err)
+	}
+	if err := addColumnIfMissing("note_keywords", "source", "TEXT NOT NULL DEFAULT 'unknown'"); err != nil {
+		log.Fatalf("Could not migrate note_keywords table: %v", err)
+	}
+	// Keys stored before this column existed replay as a plain redirect to the index
+	if err := addColumnIfMissing("idempotency_keys", "redirect", "TEXT"); err != nil {
+		log.Fatalf("Could not migrate idempotency_keys table: %v", err)
+	}
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already present,
+// so databases created by older versions pick up new schema.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan column of table %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of table %s: %v", table, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	return nil
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minTermLength is the shortest word, in runes, counted as a term.
+const minTermLength = 3
+
+// termCount is a word of a note and how often it occurs.
+type termCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// noteTerms splits content into lowercased words and counts them, leaving out
+// stopwords, numbers and words shorter than minTermLength. The most frequent come
+// first; ties keep the order in which the words first appear.
+func noteTerms(content string) []termCount {
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var terms []termCount
+	index := make(map[string]int)
+	for _, w := range words {
+		if utf8.RuneCountInString(w) < minTermLength || stopwords[w] || isNumber(w) {
+			continue
+		}
+		if i, ok := index[w]; ok {
+			terms[i].Count++
+			continue
+		}
+		index[w] = len(terms)
+		terms = append(terms, termCount{Term: w, Count: 1})
+	}
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].Count > terms[j].Count })
+	return terms
+}
+
+// isNumber reports whether a word consists of digits only.
+func isNumber(w string) bool {
+	return strings.IndexFunc(w, func(r rune) bool { return !unicode.IsDigit(r) }) < 0
+}
+
+// fallbackKeywords extracts keywords without the API, for when it fails: the date
+// keywords of the content followed by its FALLBACK_KEYWORDS (default 5) most frequent
+// terms.
+func fallbackKeywords(content string) []string {
+	terms := noteTerms(content)
+	if n := envInt("FALLBACK_KEYWORDS", 5); len(terms) > n {
+		terms = terms[:n]
+	}
+	names := make([]string, 0, len(terms))
+	for _, t := range terms {
+		names = append(names, t.Term)
+	}
+	return mergeKeywords(extractDateKeywords(content), names)
+}
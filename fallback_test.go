@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNoteTerms(t *testing.T) {
+	initStopwords()
+	got := noteTerms("Budget meeting: the budget for 2025 is due. Meeting notes, budget! Ok, go to Oslo.")
+	want := []termCount{
+		{"budget", 3},
+		{"meeting", 2},
+		// Ties keep the order of first appearance
+		{"due", 1},
+		{"notes", 1},
+		{"oslo", 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("noteTerms = %v, want %v", got, want)
+	}
+}
+
+func TestFallbackKeywords(t *testing.T) {
+	initStopwords()
+	t.Setenv("DATE_KEYWORD_GRANULARITIES", "")
+	content := "Release plan 2025-06-15: release notes, release party, plan the party with cake"
+
+	t.Setenv("FALLBACK_KEYWORDS", "")
+	want := []string{"2025-06-15", "release", "plan", "party", "notes", "cake"}
+	if got := fallbackKeywords(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("fallbackKeywords = %v, want %v", got, want)
+	}
+
+	t.Setenv("FALLBACK_KEYWORDS", "2")
+	want = []string{"2025-06-15", "release", "plan"}
+	if got := fallbackKeywords(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("fallbackKeywords with FALLBACK_KEYWORDS=2 = %v, want %v", got, want)
+	}
+}
@@ -1,29 +1,156 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// indexPageData is the data rendered by index.html, both for the full note list
+// and for notes filtered by a keyword.
+type indexPageData struct {
+	Notes    []NoteWithKeywords
+	Keywords []Keyword
+	// MoreKeywords reports that Keywords is cut short; the rest are on /keywords.
+	MoreKeywords bool
+	// ActiveKeyword is the keyword the notes are filtered by, if any.
+	ActiveKeyword string
+	// Related lists keywords co-occurring with the filtered keyword, if any.
+	Related []KeywordUsage
+	// Form holds the submitted create form when it is re-rendered after a validation error.
+	Form noteForm
+	// Heading replaces the default notes list heading for special views such as /today.
+	Heading string
+	// Filter describes what a filtered view matches, such as its keyword, so an empty
+	// result can say what found nothing.
+	Filter string
+	// NoResults reports a filtered view that matches no notes, as opposed to no notes at all.
+	NoResults bool
+	// NotesHidden reports that NOTES_LIMIT cut the list short.
+	NotesHidden bool
+	// Sort is the chosen ?sort= order in views that offer one, and empty elsewhere.
+	Sort string
+	// WeekCount is the number of notes created this week, for the link to /week.
+	WeekCount int
+	// Flash is a one-off message about the outcome of the previous action.
+	Flash string
+	// Agenda splits Notes into Upcoming, ordered by their next date, and Other.
+	Agenda   bool
+	Upcoming []NoteWithKeywords
+	Other    []NoteWithKeywords
+}
+
+// noteForm is the state of the create form: what the user typed and what was wrong with it.
+type noteForm struct {
+	Content        string
+	Keywords       string
+	ExpiresIn      string
+	IdempotencyKey string
+	Error          string
+}
+
 // listNotesHandler handles requests to the root path and displays notes (with optional keyword filters)
 func listNotesHandler(w http.ResponseWriter, r *http.Request) {
-	// Retrieve notes and their keywords
+	sortBy, orderBy, ok := noteOrder(r.URL.Query().Get("sort"))
+	if !ok {
+		http.Error(w, "sort must be one of "+noteSortNames(), http.StatusBadRequest)
+		return
+	}
+	pageData, err := loadIndexPage(orderBy, envInt("NOTES_LIMIT", 200), "")
+	if err != nil {
+		log.Printf("Error querying notes: %v", err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+	if v := r.URL.Query().Get("deleted"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			pageData.Flash = fmt.Sprintf("Deleted %d note(s).", n)
+		}
+	}
+	if flash := keywordChangeFlash(r.URL.Query()); flash != "" {
+		pageData.Flash = flash
+	}
+	pageData.Sort = sortBy
+	if r.URL.Query().Get("view") == "agenda" {
+		pageData.Agenda = true
+		pageData.Upcoming, pageData.Other = splitAgenda(pageData.Notes, time.Now().Format("2006-01-02"))
+	}
+	renderPage(w, r, http.StatusOK, "index.html", pageData)
+}
+
+// splitAgenda partitions notes into those with a date keyword on or after today,
+// ordered by their earliest such date, and the rest in their original order.
+func splitAgenda(notes []NoteWithKeywords, today string) (upcoming, other []NoteWithKeywords) {
+	next := make(map[string]string)
+	for _, n := range notes {
+		for _, k := range n.Keywords {
+			if isoDatePattern.FindString(k.Name) != k.Name || k.Name < today {
+				continue
+			}
+			if d, ok := next[n.Note.ID]; !ok || k.Name < d {
+				next[n.Note.ID] = k.Name
+			}
+		}
+		if _, ok := next[n.Note.ID]; ok {
+			upcoming = append(upcoming, n)
+		} else {
+			other = append(other, n)
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return next[upcoming[i].Note.ID] < next[upcoming[j].Note.ID]
+	})
+	return upcoming, other
+}
+
+// loadIndexPage collects all unexpired notes with their keywords, ordered by orderBy,
+// a clause from noteOrder, or newest first if it is empty, along with the keyword
+// list for the index page. A positive limit caps the number of notes, and the page
+// data tells when notes were left out. A non-empty filter is an extra SQL condition
+// on the notes (aliased n) with args as its parameters.
+func loadIndexPage(orderBy string, limit int, filter string, args ...any) (indexPageData, error) {
+	if orderBy == "" {
+		orderBy = noteSortOrders[defaultNoteSort]
+	}
+	where := "(n.expires_at IS NULL OR n.expires_at > ?)"
+	if filter != "" {
+		where += " AND (" + filter + ")"
+	}
+	// Fetch one note past the limit to tell whether any were left out; SQLite reads
+	// a negative LIMIT as none
+	sqlLimit := -1
+	if limit > 0 {
+		sqlLimit = limit + 1
+	}
+	// Retrieve notes and their keywords; the limit applies to notes, not joined rows
 	rows, err := db.Query(
-		`SELECT n.id, n.content, n.created_at, k.name
-		 FROM notes n
+		`SELECT n.id, n.content, n.created_at, n.starred, k.name
+		 FROM (SELECT * FROM notes n WHERE `+where+` ORDER BY `+orderBy+` LIMIT ?) n
 		 LEFT JOIN note_keywords nk ON n.id = nk.note_id
 		 LEFT JOIN keywords k ON nk.keyword_id = k.id
-		 ORDER BY n.created_at DESC`,
+		 ORDER BY `+orderBy,
+		append(append([]any{time.Now()}, args...), sqlLimit)...,
 	)
 	if err != nil {
-		log.Printf("Error querying notes: %v", err)
-		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
-		return
+		return indexPageData{}, err
 	}
 	defer rows.Close()
 
@@ -33,13 +160,14 @@ func listNotesHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var id, content string
 		var createdAt time.Time
+		var starred bool
 		var kwName sql.NullString
-		if err := rows.Scan(&id, &content, &createdAt, &kwName); err != nil {
+		if err := rows.Scan(&id, decoded(&content), &createdAt, &starred, &kwName); err != nil {
 			log.Printf("Error scanning note row: %v", err)
 			continue
 		}
 		if _, exists := noteMap[id]; !exists {
-			noteMap[id] = &NoteWithKeywords{Note: Note{ID: id, Content: content, CreatedAt: createdAt}}
+			noteMap[id] = &NoteWithKeywords{Note: Note{ID: id, Content: content, CreatedAt: createdAt, Starred: starred}}
 			order = append(order, id)
 		}
 		if kwName.Valid {
@@ -50,158 +178,395 @@ func listNotesHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Row iteration error: %v", err)
 	}
 
+	hidden := false
+	if limit > 0 && len(order) > limit {
+		order, hidden = order[:limit], true
+	}
+
 	// Build slice in original order
 	notes := make([]NoteWithKeywords, 0, len(order))
 	for _, id := range order {
 		notes = append(notes, *noteMap[id])
 	}
 
-	// Retrieve all keywords for filter list
-	kwRows, err := db.Query("SELECT name FROM keywords ORDER BY name")
+	// Retrieve the most used keywords for the filter list
+	allKeywords, moreKeywords := sidebarKeywords()
+
+	return indexPageData{
+		Notes:        notes,
+		Keywords:     allKeywords,
+		MoreKeywords: moreKeywords,
+		NotesHidden:  hidden,
+		WeekCount:    weekNoteCount(),
+	}, nil
+}
+
+// weekNoteCount returns the number of unexpired notes created this week. Errors are
+// logged and count as zero, since the count is only a hint next to the /week link.
+func weekNoteCount() int {
+	from, to := currentWeek(time.Now())
+	var n int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM notes WHERE (expires_at IS NULL OR expires_at > ?) AND created_at >= ? AND created_at < ?",
+		time.Now(), from, to,
+	).Scan(&n)
+	if err != nil {
+		log.Printf("Error counting notes of this week: %v", err)
+	}
+	return n
+}
+
+// sidebarKeywords returns the SIDEBAR_KEYWORDS most used keywords for the filter
+// list and whether there are more. Errors are logged rather than failing the page
+// since the list is not essential to it.
+func sidebarKeywords() ([]Keyword, bool) {
+	usage, err := keywordUsage(0)
 	if err != nil {
 		log.Printf("Error querying keywords: %v", err)
 	}
-	defer func() {
-		if kwRows != nil {
-			kwRows.Close()
-		}
-	}()
-	var allKeywords []Keyword
-	for kwRows != nil && kwRows.Next() {
-		var k Keyword
-		if err := kwRows.Scan(&k.Name); err != nil {
-			log.Printf("Error scanning keyword: %v", err)
-			continue
-		}
-		allKeywords = append(allKeywords, k)
+	more := false
+	if limit := envInt("SIDEBAR_KEYWORDS", 30); len(usage) > limit {
+		usage, more = usage[:limit], true
 	}
-	if kwRows != nil {
-		if err := kwRows.Err(); err != nil {
-			log.Printf("Keyword row iteration error: %v", err)
-		}
+	keywords := make([]Keyword, len(usage))
+	for i, k := range usage {
+		keywords[i] = Keyword{Name: k.Name}
 	}
+	return keywords, more
+}
 
-	pageData := struct {
-		Notes    []NoteWithKeywords
-		Keywords []Keyword
-	}{
-		Notes:    notes,
-		Keywords: allKeywords,
-	}
+// renderCreateFormError re-renders the index page with the submitted form and an
+// inline validation message, so that nothing the user typed is lost.
+func renderCreateFormError(w http.ResponseWriter, r *http.Request, form noteForm) {
+	renderCreateFormStatus(w, r, http.StatusBadRequest, form)
+}
 
-	if err := templates.ExecuteTemplate(w, "index.html", pageData); err != nil {
-		log.Printf("Error executing index template: %v", err)
-		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+// renderCreateFormStatus is renderCreateFormError with a status other than 400.
+func renderCreateFormStatus(w http.ResponseWriter, r *http.Request, status int, form noteForm) {
+	pageData, err := loadIndexPage("", 0, "")
+	if err != nil {
+		log.Printf("Error querying notes: %v", err)
+		http.Error(w, form.Error, status)
+		return
 	}
+	pageData.Form = form
+	renderPage(w, r, status, "index.html", pageData)
 }
 
-// createNoteHandler handles requests to create a new note
+// blockedContentMessage is shown when content matches a BLOCKLIST_FILE pattern.
+const blockedContentMessage = "This note contains content that is not allowed on this instance"
+
+// maxUploadBytes limits the size of a text file uploaded as note content.
+const maxUploadBytes = 1 << 20
+
+// createNoteHandler handles requests to create a new note. The content comes from an
+// uploaded text file if one is attached, otherwise from the content field.
 func createNoteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
+	// Leave room for the other form fields next to the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes+64<<10)
+	form := noteForm{
+		Content:        r.FormValue("content"),
+		Keywords:       r.FormValue("keywords"),
+		ExpiresIn:      r.FormValue("expires_in"),
+		IdempotencyKey: idempotencyKey(r),
 	}
 
-	content := r.FormValue("content")
+	file, header, err := r.FormFile("file")
+	switch {
+	case err == nil:
+		defer file.Close()
+		text, err := readUploadedText(file, header)
+		if err != nil {
+			form.Error = "Upload rejected: " + err.Error()
+			renderCreateFormError(w, r, form)
+			return
+		}
+		form.Content = text
+	case err != http.ErrMissingFile && err != http.ErrNotMultipart:
+		form.Error = "The upload is too large or malformed"
+		renderCreateFormError(w, r, form)
+		return
+	}
+	content := normalizeContent(form.Content)
 
 	if content == "" {
-		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		form.Error = "Content cannot be empty"
+		renderCreateFormError(w, r, form)
+		return
+	}
+	if name := blockedBy(content); name != "" {
+		log.Printf("Rejected new note matching blocklist pattern %q", name)
+		form.Error = blockedContentMessage
+		renderCreateFormStatus(w, r, http.StatusUnprocessableEntity, form)
 		return
 	}
 
-	newID := strconv.FormatInt(time.Now().UnixNano(), 10)
-	createdAt := time.Now()
-	if _, err := db.Exec(
-		"INSERT INTO notes(id, content, created_at) VALUES(?, ?, ?)",
-		newID, content, createdAt,
-	); err != nil {
+	var expiresAt *time.Time
+	if v := form.ExpiresIn; v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 {
+			form.Error = "Invalid expiry"
+			renderCreateFormError(w, r, form)
+			return
+		}
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+
+	// A repeated submission of the same form is answered as the first one was. The
+	// key is checked before extraction, so a double submit costs no second model call
+	if repeatedCreate(w, r, db, form.IdempotencyKey) {
+		return
+	}
+
+	// Extraction waits for the model, so it runs before the request's transaction is
+	// begun by txFromContext; the transaction holds the write lock from then on
+	var extracted []keywordLink
+	if form.Keywords == "" {
+		extracted = autoKeywords(r.Context(), content)
+	}
+
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	// Checked again under the lock, since the first submission may still have been
+	// saving during the check above
+	if repeatedCreate(w, r, tx, form.IdempotencyKey) {
+		return
+	}
+
+	// given holds the typed or extracted keywords, without the defaults every note gets
+	var keywords, given []keywordLink
+	redirect := "/"
+	switch {
+	case wantsNoKeywords(form.Keywords):
+	case form.Keywords != "":
+		given = linksFrom(sourceManual, parseKeywordInput(form.Keywords))
+		keywords = slices.Concat(given, linksFrom(sourceDefault, defaultKeywords()))
+	default:
+		given = extracted
+		keywords = slices.Concat(given, linksFrom(sourceDefault, defaultKeywords()))
+		added, reused, err := splitNewKeywords(tx, linkNames(keywords))
+		if err != nil {
+			log.Printf("Error comparing extracted keywords: %v", err)
+			http.Error(w, "Error saving note", http.StatusInternalServerError)
+			return
+		}
+		redirect += keywordChangeQuery(added, reused)
+	}
+	// Names that linkKeywords would drop as filler do not count either
+	if envBool("REQUIRE_KEYWORDS") && !slices.ContainsFunc(given, func(link keywordLink) bool { return linkDropReason(link) == "" }) {
+		form.Error = "Add at least one keyword; none were given or found in the content"
+		renderCreateFormError(w, r, form)
+		return
+	}
+
+	noteID, err := insertNote(r.Context(), tx, content, expiresAt, keywords)
+	if err != nil {
+		if limitReached(w, err) {
+			return
+		}
 		log.Printf("Error inserting new note: %v", err)
 		http.Error(w, "Error saving note", http.StatusInternalServerError)
 		return
 	}
+	if form.IdempotencyKey != "" {
+		if err := storeIdempotencyKey(tx, form.IdempotencyKey, noteID, redirect); err != nil {
+			log.Printf("Error storing idempotency key for note %s: %v", noteID, err)
+			http.Error(w, "Error saving note", http.StatusInternalServerError)
+			return
+		}
+	}
+	fireNoteWebhook(r.Context(), tx, eventNoteCreated, noteID)
 
-	if kwInput := r.FormValue("keywords"); kwInput != "" {
-		for _, part := range strings.Split(kwInput, ",") {
-			name := strings.TrimSpace(part)
-			if name == "" {
-				continue
-			}
-			if _, err := db.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", name); err != nil {
-				log.Printf("Error inserting keyword %q: %v", name, err)
-				continue
-			}
-			var kid int
-			if err := db.QueryRow("SELECT id FROM keywords WHERE name = ?", name).Scan(&kid); err != nil {
-				log.Printf("Error retrieving keyword ID for %q: %v", name, err)
-				continue
-			}
-			if _, err := db.Exec("INSERT OR IGNORE INTO note_keywords(note_id, keyword_id) VALUES(?, ?)", newID, kid); err != nil {
-				log.Printf("Error linking note %s with keyword %q: %v", newID, name, err)
-			}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// repeatedCreate answers a create form submission whose idempotency key already
+// created a note with the redirect the first submission got, including its keyword
+// message, and reports whether it did. A failed lookup is answered with 500 and
+// counts as answered.
+func repeatedCreate(w http.ResponseWriter, r *http.Request, q queryRower, key string) bool {
+	if key == "" {
+		return false
+	}
+	existingID, redirect, err := noteForIdempotencyKey(q, key)
+	if err != nil {
+		log.Printf("Error looking up idempotency key: %v", err)
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return true
+	}
+	if existingID == "" {
+		return false
+	}
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+	return true
+}
+
+// maxCaptureBytes limits the size of a quick-capture request body.
+const maxCaptureBytes = 1 << 20
+
+// uploadExtensions are the file extensions accepted as text uploads regardless of
+// the content type the browser declares for them.
+var uploadExtensions = map[string]bool{".txt": true, ".md": true}
+
+// readUploadedText returns the contents of an uploaded file, rejecting anything that
+// is not UTF-8 text or is larger than maxUploadBytes.
+func readUploadedText(file multipart.File, header *multipart.FileHeader) (string, error) {
+	// Browsers often label .md files application/octet-stream, so the extension counts too
+	mediaType, _, _ := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "text/") && !uploadExtensions[strings.ToLower(filepath.Ext(header.Filename))] {
+		return "", errors.New("only text files (.txt, .md) can be uploaded")
+	}
+	if header.Size > maxUploadBytes {
+		return "", fmt.Errorf("the file is larger than %d KB", maxUploadBytes>>10)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadBytes))
+	if err != nil {
+		return "", errors.New("the file could not be read")
+	}
+	if !utf8.Valid(data) {
+		return "", errors.New("the file is not valid UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// captureHandler creates a note from a plain-text request body and responds with
+// 204 No Content. Date and default keywords are linked right away; AI keyword
+// extraction is queued to run in the background.
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != "text/plain" {
+			http.Error(w, "Content-Type must be text/plain", http.StatusUnsupportedMediaType)
+			return
 		}
-	} else {
-		var existing []string
-		kwRows, err := db.Query("SELECT name FROM keywords ORDER BY name")
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCaptureBytes))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	content := normalizeContent(string(body))
+	if content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if name := blockedBy(content); name != "" {
+		log.Printf("Rejected captured note matching blocklist pattern %q", name)
+		http.Error(w, blockedContentMessage, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A retried capture with the same key returns the note created the first time
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	key := idempotencyKey(r)
+	if key != "" {
+		existingID, _, err := noteForIdempotencyKey(tx, key)
 		if err != nil {
-			log.Printf("Error querying existing keywords: %v", err)
-		} else {
-			defer kwRows.Close()
-			for kwRows.Next() {
-				var k string
-				if err := kwRows.Scan(&k); err != nil {
-					log.Printf("Error scanning existing keyword: %v", err)
-					continue
-				}
-				existing = append(existing, k)
-			}
-			if err := kwRows.Err(); err != nil {
-				log.Printf("Existing keywords iteration error: %v", err)
-			}
+			log.Printf("Error looking up idempotency key: %v", err)
+			http.Error(w, "Error saving note", http.StatusInternalServerError)
+			return
 		}
-		autoKeys, err := extractKeywords(content, existing)
-		if err != nil {
-			log.Printf("Error extracting keywords: %v", err)
-		} else {
-			for _, name := range autoKeys {
-				if _, err := db.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", name); err != nil {
-					log.Printf("Error inserting keyword %q: %v", name, err)
-					continue
-				}
-				var kid int
-				if err := db.QueryRow("SELECT id FROM keywords WHERE name = ?", name).Scan(&kid); err != nil {
-					log.Printf("Error retrieving keyword ID for %q: %v", name, err)
-					continue
-				}
-				if _, err := db.Exec("INSERT OR IGNORE INTO note_keywords(note_id, keyword_id) VALUES(?, ?)", newID, kid); err != nil {
-					log.Printf("Error linking note %s with keyword %q: %v", newID, name, err)
-				}
-			}
+		if existingID != "" {
+			w.Header().Set("Location", "/notes/"+existingID)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	keywords := slices.Concat(linksFrom(sourceDate, extractDateKeywords(content)), linksFrom(sourceDefault, defaultKeywords()))
+	noteID, err := insertNote(r.Context(), tx, content, nil, keywords)
+	if err != nil {
+		if limitReached(w, err) {
+			return
+		}
+		log.Printf("Error inserting captured note: %v", err)
+		http.Error(w, "Error saving note", http.StatusInternalServerError)
+		return
+	}
+	if key != "" {
+		if err := storeIdempotencyKey(tx, key, noteID, ""); err != nil {
+			log.Printf("Error storing idempotency key for note %s: %v", noteID, err)
+			http.Error(w, "Error saving note", http.StatusInternalServerError)
+			return
 		}
 	}
+	fireNoteWebhook(r.Context(), tx, eventNoteCreated, noteID)
+	// The job must not start before the note is committed, or not at all if it is not
+	if aiEnabled {
+		onCommit(r.Context(), func() {
+			aiJobs.enqueue(aiJob{
+				name: "keyword extraction for note " + noteID,
+				ctx:  context.WithoutCancel(r.Context()),
+				run: func(ctx context.Context) error {
+					return extractAndLinkKeywords(ctx, noteID, content)
+				},
+			})
+		})
+	}
+
+	w.Header().Set("Location", "/notes/"+noteID)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+// limitReached answers with 403 and reports true when err is caused by the
+// MAX_NOTES or MAX_KEYWORDS cap.
+func limitReached(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, errNoteLimit) || errors.Is(err, errKeywordLimit) {
+		http.Error(w, "Cannot save: "+err.Error(), http.StatusForbidden)
+		return true
+	}
+	return false
 }
 
 // viewNoteHandler handles requests to view a single note
 func viewNoteHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 || parts[2] == "" {
-		http.Error(w, "Note ID is missing", http.StatusBadRequest)
-		return
-	}
-	noteID := parts[2]
+	renderNote(w, r, "id", r.PathValue("id"), false)
+}
+
+// slugNoteHandler handles requests to view a note by its human-readable slug.
+func slugNoteHandler(w http.ResponseWriter, r *http.Request) {
+	renderNote(w, r, "slug", r.PathValue("slug"), false)
+}
+
+// sharedNoteHandler renders a note looked up by its share token, read-only.
+func sharedNoteHandler(w http.ResponseWriter, r *http.Request) {
+	renderNote(w, r, "share_token", r.PathValue("token"), true)
+}
 
+// renderNote renders the note whose column matches value. Shared views hide the
+// controls for changing the note and links into the rest of the app.
+func renderNote(w http.ResponseWriter, r *http.Request, column, value string, shared bool) {
 	var note Note
+	var expiresAt sql.NullTime
+	var shareToken, slug sql.NullString
 	err := db.QueryRow(
-		"SELECT id, content, created_at FROM notes WHERE id = ?",
-		noteID,
-	).Scan(&note.ID, &note.Content, &note.CreatedAt)
+		"SELECT id, content, created_at, expires_at, locked, starred, share_token, slug FROM notes WHERE "+column+" = ?",
+		value,
+	).Scan(&note.ID, decoded(&note.Content), &note.CreatedAt, &expiresAt, &note.Locked, &note.Starred, &shareToken, &slug)
+	if expiresAt.Valid {
+		note.ExpiresAt = &expiresAt.Time
+	}
+	note.ShareToken = shareToken.String
+	note.Slug = slug.String
+	noteID := note.ID
 
 	// Prepare keyword list for this note
 	var noteKeywords []Keyword
 	if err == nil {
 		krows, kerr := db.Query(
-			"SELECT k.name FROM keywords k JOIN note_keywords nk ON k.id = nk.keyword_id WHERE nk.note_id = ?",
+			"SELECT k.name, nk.source FROM keywords k JOIN note_keywords nk ON k.id = nk.keyword_id WHERE nk.note_id = ?",
 			noteID,
 		)
 		if kerr != nil {
@@ -210,7 +575,7 @@ func viewNoteHandler(w http.ResponseWriter, r *http.Request) {
 			defer krows.Close()
 			for krows.Next() {
 				var k Keyword
-				if err := krows.Scan(&k.Name); err != nil {
+				if err := krows.Scan(&k.Name, &k.Source); err != nil {
 					log.Printf("Error scanning keyword for note %s: %v", noteID, err)
 					continue
 				}
@@ -226,247 +591,1246 @@ func viewNoteHandler(w http.ResponseWriter, r *http.Request) {
 		Note     Note
 		Found    bool
 		Keywords []Keyword
+		Shared   bool
+		Flash    string
 	}{
 		Note:     note,
 		Found:    err == nil,
 		Keywords: noteKeywords,
+		Shared:   shared,
+	}
+	if !shared {
+		templateData.Flash = takeFlash(w, r)
+		if flash := keywordChangeFlash(r.URL.Query()); flash != "" {
+			templateData.Flash = flash
+		}
 	}
 
+	status := http.StatusOK
 	if err == sql.ErrNoRows {
-		w.WriteHeader(http.StatusNotFound)
+		status = http.StatusNotFound
 	} else if err != nil {
 		log.Printf("Error querying note: %v", err)
 		http.Error(w, "Error fetching note", http.StatusInternalServerError)
 		return
 	}
 
-	if err := templates.ExecuteTemplate(w, "note.html", templateData); err != nil {
-		log.Printf("Error executing note template: %v", err)
-		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	// Changes to a note redirect back to its page, so browsers must revalidate it
+	// every time; an unchanged page still costs only a 304 thanks to the ETag
+	if status == http.StatusOK {
+		w.Header().Set("Cache-Control", "private, no-cache")
 	}
+	renderPage(w, r, status, "note.html", templateData)
 }
 
-// editNoteHandler handles displaying and updating an existing note, including re-extracting keywords.
-func editNoteHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 4 || parts[3] == "" {
-		http.Error(w, "Note ID is missing", http.StatusBadRequest)
+// rawNoteHandler returns just the content of a note as plain text.
+func rawNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var content string
+	err := db.QueryRow("SELECT content FROM notes WHERE id = ?", noteID).Scan(decoded(&content))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
 		return
 	}
-	noteID := parts[3]
-	if r.Method == http.MethodGet {
-		var note Note
-		err := db.QueryRow("SELECT id, content, created_at FROM notes WHERE id = ?", noteID).Scan(&note.ID, &note.Content, &note.CreatedAt)
-		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
-			return
-		} else if err != nil {
-			log.Printf("Error querying note for edit %s: %v", noteID, err)
-			http.Error(w, "Error fetching note", http.StatusInternalServerError)
-			return
-		}
-		var noteKeywords []Keyword
-		kwRows, err := db.Query("SELECT k.name FROM keywords k JOIN note_keywords nk ON k.id = nk.keyword_id WHERE nk.note_id = ?", noteID)
-		if err != nil {
-			log.Printf("Error querying keywords for note %s: %v", noteID, err)
-		} else {
-			defer kwRows.Close()
-			for kwRows.Next() {
-				var k string
-				if err := kwRows.Scan(&k); err != nil {
-					log.Printf("Error scanning keyword for note %s: %v", noteID, err)
-					continue
-				}
-				noteKeywords = append(noteKeywords, Keyword{Name: k})
-			}
-			if err := kwRows.Err(); err != nil {
-				log.Printf("Keyword rows iteration error for note %s: %v", noteID, err)
-			}
-		}
-		templateData := struct {
-			Note     Note
-			Keywords []Keyword
-		}{
-			Note:     note,
-			Keywords: noteKeywords,
-		}
-		if err := templates.ExecuteTemplate(w, "edit_note.html", templateData); err != nil {
-			log.Printf("Error executing edit template: %v", err)
-			http.Error(w, "Error rendering edit page", http.StatusInternalServerError)
-		}
-	} else if r.Method == http.MethodPost {
-		content := r.FormValue("content")
-		if content == "" {
-			http.Error(w, "Content cannot be empty", http.StatusBadRequest)
-			return
-		}
-		if _, err := db.Exec("UPDATE notes SET content = ? WHERE id = ?", content, noteID); err != nil {
-			log.Printf("Error updating note %s: %v", noteID, err)
-			http.Error(w, "Error updating note", http.StatusInternalServerError)
-			return
-		}
-		if _, err := db.Exec("DELETE FROM note_keywords WHERE note_id = ?", noteID); err != nil {
-			log.Printf("Error clearing keywords for note %s: %v", noteID, err)
-		}
-		if kwInput := r.FormValue("keywords"); kwInput != "" {
-			for _, part := range strings.Split(kwInput, ",") {
-				name := strings.TrimSpace(part)
-				if name == "" {
-					continue
-				}
-				if _, err := db.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", name); err != nil {
-					log.Printf("Error inserting keyword %q: %v", name, err)
-					continue
-				}
-				var kid int
-				if err := db.QueryRow("SELECT id FROM keywords WHERE name = ?", name).Scan(&kid); err != nil {
-					log.Printf("Error retrieving keyword ID for %q: %v", name, err)
-					continue
-				}
-				if _, err := db.Exec("INSERT OR IGNORE INTO note_keywords(note_id, keyword_id) VALUES(?, ?)", noteID, kid); err != nil {
-					log.Printf("Error linking note %s with keyword %q: %v", noteID, name, err)
-				}
-			}
-		} else {
-			var existing []string
-			kwRows, err := db.Query("SELECT name FROM keywords ORDER BY name")
-			if err != nil {
-				log.Printf("Error querying existing keywords: %v", err)
-			} else {
-				defer kwRows.Close()
-				for kwRows.Next() {
-					var k string
-					if err := kwRows.Scan(&k); err != nil {
-						log.Printf("Error scanning existing keyword: %v", err)
-						continue
-					}
-					existing = append(existing, k)
-				}
-				if err := kwRows.Err(); err != nil {
-					log.Printf("Existing keywords iteration error: %v", err)
-				}
-			}
-			autoKeys, err := extractKeywords(content, existing)
-			if err != nil {
-				log.Printf("Error extracting keywords on update: %v", err)
-			} else {
-				for _, name := range autoKeys {
-					if _, err := db.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", name); err != nil {
-						log.Printf("Error inserting keyword %q: %v", name, err)
-						continue
-					}
-					var kid int
-					if err := db.QueryRow("SELECT id FROM keywords WHERE name = ?", name).Scan(&kid); err != nil {
-						log.Printf("Error retrieving keyword ID for %q: %v", name, err)
-						continue
-					}
-					if _, err := db.Exec("INSERT OR IGNORE INTO note_keywords(note_id, keyword_id) VALUES(?, ?)", noteID, kid); err != nil {
-						log.Printf("Error linking note %s with keyword %q: %v", noteID, name, err)
-					}
-				}
-			}
-		}
-		http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
-	} else {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, content)
 }
 
-func initTemplates() {
-	templateDir := "templates"
-	// Check if running from project root or if templates dir is directly accessible
-	if _, err := os.Stat(templateDir); os.IsNotExist(err) {
-		// If not found, try to locate it relative to the executable's path
-		// This is more robust for deployed binaries.
-		exePath, err := os.Executable()
-		if err != nil {
-			log.Fatalf("Could not get executable path: %v", err)
-		}
-		exeDir := filepath.Dir(exePath)
-		tryPath := filepath.Join(exeDir, "templates")
-		if _, err := os.Stat(tryPath); os.IsNotExist(err) {
-			// Fallback to checking relative to current working directory (common for `go run`)
-			wd, _ := os.Getwd()
-			tryPathWd := filepath.Join(wd, "templates")
-			if _, err := os.Stat(tryPathWd); os.IsNotExist(err) {
-				log.Fatalf("Templates directory not found at %s, %s, or ./templates. Ensure it exists.", tryPath, tryPathWd)
-			}
-			templateDir = tryPathWd
-		} else {
-			templateDir = tryPath
+// noteTermsHandler returns a note's most frequent words, leaving out stopwords, as
+// JSON: [{"term": "...", "count": N}]. It works without AI; ?limit= sets how many
+// terms are returned (default 20).
+func noteTermsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
 		}
+		limit = n
 	}
-
-	log.Printf("Loading templates from: %s", templateDir)
-	// Initialize templates with custom functions (e.g., for content truncation)
-	funcMap := template.FuncMap{
-		"shorten": func(s string) string {
-			if len(s) > 100 {
-				return s[:100] + "..."
-			}
-			return s
-		},
-		"joinKeywords": func(keys []Keyword) string {
-			var names []string
-			for _, k := range keys {
-				names = append(names, k.Name)
-			}
-			return strings.Join(names, ", ")
-		},
-	}
-	templates = template.Must(
-		template.New("").Funcs(funcMap).
-			ParseGlob(filepath.Join(templateDir, "*.html")),
-	)
-}
-
-// listKeywordsHandler displays a page with all available keywords
-func listKeywordsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT name FROM keywords ORDER BY name")
-	if err != nil {
-		log.Printf("Error querying keywords: %v", err)
-		http.Error(w, "Error fetching keywords", http.StatusInternalServerError)
+	noteID := r.PathValue("id")
+	var content string
+	err := db.QueryRow("SELECT content FROM notes WHERE id = ?", noteID).Scan(decoded(&content))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var keywords []Keyword
-	for rows.Next() {
-		var k Keyword
-		if err := rows.Scan(&k.Name); err != nil {
-			log.Printf("Error scanning keyword: %v", err)
-			continue
-		}
-		keywords = append(keywords, k)
+	terms := noteTerms(content)
+	if len(terms) > limit {
+		terms = terms[:limit]
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("Keyword row iteration error: %v", err)
-	}
-
-	if err := templates.ExecuteTemplate(w, "keywords.html", keywords); err != nil {
-		log.Printf("Error executing keywords template: %v", err)
-		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	if terms == nil {
+		terms = []termCount{}
 	}
+	writeJSON(w, http.StatusOK, terms)
 }
 
-// notesByKeywordHandler displays notes associated with a specific keyword
-func notesByKeywordHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) < 3 || parts[2] == "" {
-		http.Error(w, "Keyword is missing", http.StatusBadRequest)
+// editNoteHandler displays the edit form for an existing note.
+func editNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var note Note
+	var draft string
+	err := db.QueryRow(
+		"SELECT id, content, created_at, locked, COALESCE(draft, '') FROM notes WHERE id = ?", noteID,
+	).Scan(&note.ID, decoded(&note.Content), &note.CreatedAt, &note.Locked, decoded(&draft))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note for edit %s: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		return
+	}
+	var noteKeywords []Keyword
+	kwRows, err := db.Query("SELECT k.name FROM keywords k JOIN note_keywords nk ON k.id = nk.keyword_id WHERE nk.note_id = ?", noteID)
+	if err != nil {
+		log.Printf("Error querying keywords for note %s: %v", noteID, err)
+	} else {
+		defer kwRows.Close()
+		for kwRows.Next() {
+			var k string
+			if err := kwRows.Scan(&k); err != nil {
+				log.Printf("Error scanning keyword for note %s: %v", noteID, err)
+				continue
+			}
+			noteKeywords = append(noteKeywords, Keyword{Name: k})
+		}
+		if err := kwRows.Err(); err != nil {
+			log.Printf("Keyword rows iteration error for note %s: %v", noteID, err)
+		}
+	}
+	// An autosaved draft that was never submitted is offered in place of the content
+	restoredDraft := draft != "" && draft != note.Content
+	if restoredDraft {
+		note.Content = draft
+	}
+	templateData := struct {
+		Note          Note
+		Keywords      []Keyword
+		RestoredDraft bool
+	}{
+		Note:          note,
+		Keywords:      noteKeywords,
+		RestoredDraft: restoredDraft,
+	}
+	if err := templates.Load().ExecuteTemplate(w, "edit_note.html", templateData); err != nil {
+		log.Printf("Error executing edit template: %v", err)
+		http.Error(w, "Error rendering edit page", http.StatusInternalServerError)
+	}
+}
+
+// noteEditable reports whether the note exists and is not locked, answering with 404
+// or 403 if it does not or is, and with 500 if the lookup fails.
+func noteEditable(w http.ResponseWriter, r *http.Request, q queryRower, noteID string) bool {
+	var locked bool
+	if err := q.QueryRow("SELECT locked FROM notes WHERE id = ?", noteID).Scan(&locked); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return false
+	} else if err != nil {
+		log.Printf("Error querying note %s for update: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return false
+	}
+	if locked {
+		http.Error(w, "This note is locked and cannot be edited", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// updateNoteHandler saves an edited note, including re-extracting keywords. With the
+// keywords field left empty only the AI and date keywords are re-extracted; manual
+// keywords stay.
+func updateNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	content := normalizeContent(r.FormValue("content"))
+	if content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if name := blockedBy(content); name != "" {
+		log.Printf("Rejected edit of note %s matching blocklist pattern %q", noteID, name)
+		http.Error(w, blockedContentMessage, http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A missing or locked note is refused before paying for a model call
+	if !noteEditable(w, r, db, noteID) {
+		return
+	}
+
+	// Extraction waits for the model, so it runs before the request's transaction is
+	// begun by txFromContext; the transaction holds the write lock from then on
+	kwInput := r.FormValue("keywords")
+	var extracted []keywordLink
+	if kwInput == "" {
+		extracted = autoKeywords(withAuditNoteID(r.Context(), noteID), content)
+	}
+
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	// Checked again under the lock, since the note may have been locked or deleted
+	// while the keywords were extracted
+	if !noteEditable(w, r, tx, noteID) {
+		return
+	}
+	previous, err := keywordSources(tx, noteID)
+	if err != nil {
+		log.Printf("Error querying keywords of note %s for update: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	var keywords []keywordLink
+	var reextract bool
+	redirect := fmt.Sprintf("/notes/%s", noteID)
+	switch {
+	case wantsNoKeywords(kwInput):
+	case kwInput != "":
+		// The form lists the current keywords, so those keep their source and only
+		// the ones typed in are manual
+		for _, name := range parseKeywordInput(kwInput) {
+			source, ok := previous[name]
+			if !ok {
+				source = sourceManual
+			}
+			keywords = append(keywords, keywordLink{Name: name, Source: source})
+		}
+		if err := recordRemovedAIKeywords(tx, noteID, previous, linkNames(keywords)); err != nil {
+			log.Printf("Error recording removed keywords of note %s: %v", noteID, err)
+			http.Error(w, "Error updating note", http.StatusInternalServerError)
+			return
+		}
+	default:
+		reextract = true
+		keywords = extracted
+		added, reused, err := splitNewKeywords(tx, linkNames(keywords))
+		if err != nil {
+			log.Printf("Error comparing extracted keywords for note %s: %v", noteID, err)
+			http.Error(w, "Error updating note", http.StatusInternalServerError)
+			return
+		}
+		redirect += keywordChangeQuery(added, reused)
+	}
+
+	stored, err := encodeContent(content)
+	if err != nil {
+		log.Printf("Error encoding note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE notes SET content = ?, draft = NULL WHERE id = ?", stored, noteID); err != nil {
+		log.Printf("Error updating note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if reextract {
+		err = clearExtractedKeywords(tx, noteID)
+	} else {
+		_, err = tx.Exec("DELETE FROM note_keywords WHERE note_id = ?", noteID)
+	}
+	if err != nil {
+		log.Printf("Error clearing keywords for note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if err := linkKeywords(r.Context(), tx, noteID, keywords); err != nil {
+		if limitReached(w, err) {
+			return
+		}
+		log.Printf("Error linking keywords to note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	fireNoteWebhook(r.Context(), tx, eventNoteUpdated, noteID)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// autosaveNoteHandler stores the edit form's content as the note's draft and responds
+// with 204 No Content. It is meant to be called periodically while editing, so it
+// only overwrites the single draft slot: the note itself and its keywords are left
+// alone until the form is submitted, which clears the draft.
+func autosaveNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var locked bool
+	if err := db.QueryRow("SELECT locked FROM notes WHERE id = ?", noteID).Scan(&locked); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for autosave: %v", noteID, err)
+		http.Error(w, "Error saving draft", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "This note is locked and cannot be edited", http.StatusForbidden)
+		return
+	}
+
+	content := normalizeContent(r.FormValue("content"))
+	if content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	draft, err := encryptContent(content)
+	if err != nil {
+		log.Printf("Error encrypting draft of note %s: %v", noteID, err)
+		http.Error(w, "Error saving draft", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE notes SET draft = ? WHERE id = ?", draft, noteID); err != nil {
+		log.Printf("Error saving draft of note %s: %v", noteID, err)
+		http.Error(w, "Error saving draft", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// suggestTitleHandler asks the model for a title for a note and returns it as JSON.
+// The suggestion is not stored; accepting it is up to the user.
+func suggestTitleHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var content string
+	err := db.QueryRow("SELECT content FROM notes WHERE id = ?", noteID).Scan(decoded(&content))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for title suggestion: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		return
+	}
+
+	if !aiEnabled {
+		http.Error(w, "AI features are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	title, err := suggestTitle(withAuditNoteID(r.Context(), noteID), content)
+	if err != nil {
+		logAIError("Error suggesting title for note "+noteID, err)
+		http.Error(w, "Error suggesting title", http.StatusBadGateway)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Title string `json:"title"`
+	}{Title: title})
+}
+
+// summaryStreamHandler streams an AI summary of a note as server-sent events. Each
+// piece of text is sent as a JSON string in a data event, followed by a "done"
+// event, or an "error" event if generation fails midway. The upstream request is
+// canceled when the client disconnects.
+func summaryStreamHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var content string
+	err := db.QueryRow("SELECT content FROM notes WHERE id = ?", noteID).Scan(decoded(&content))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for summary: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		return
+	}
+
+	if !aiEnabled {
+		http.Error(w, "AI features are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	started := false
+	err = streamSummary(r.Context(), content, func(delta string) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			started = true
+		}
+		data, err := json.Marshal(delta)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			return // client went away
+		}
+		logAIError("Error streaming summary for note "+noteID, err)
+		if !started {
+			http.Error(w, "Error generating summary", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "event: error\ndata: \"Error generating summary\"\n\n")
+		flusher.Flush()
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	fmt.Fprint(w, "event: done\ndata: \n\n")
+	flusher.Flush()
+}
+
+// todayHandler lists the notes tagged with today's ISO date keyword together with
+// the notes created today.
+func todayHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 1)
+	today := from.Format("2006-01-02")
+
+	pageData, err := loadIndexPage("", 0,
+		`n.id IN (SELECT nk2.note_id FROM note_keywords nk2 JOIN keywords k2 ON k2.id = nk2.keyword_id WHERE k2.name = ?)
+		 OR (n.created_at >= ? AND n.created_at < ?)`,
+		today, from, to,
+	)
+	if err != nil {
+		log.Printf("Error querying notes for today: %v", err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+	pageData.Heading = "Today, " + today
+	pageData.Filter = today
+	pageData.NoResults = len(pageData.Notes) == 0
+	renderPage(w, r, http.StatusOK, "index.html", pageData)
+}
+
+// currentWeek returns the start of the ISO week containing now, Monday at midnight
+// local time, and the start of the next week.
+func currentWeek(now time.Time) (from, to time.Time) {
+	from = time.Date(now.Year(), now.Month(), now.Day()-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.Local)
+	return from, from.AddDate(0, 0, 7)
+}
+
+// weekHandler lists the notes created in the current ISO week.
+func weekHandler(w http.ResponseWriter, r *http.Request) {
+	from, to := currentWeek(time.Now())
+	year, week := from.ISOWeek()
+
+	pageData, err := loadIndexPage("", 0, "n.created_at >= ? AND n.created_at < ?", from, to)
+	if err != nil {
+		log.Printf("Error querying notes for this week: %v", err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+	pageData.Heading = fmt.Sprintf("This week, %d-W%02d", year, week)
+	pageData.Filter = "this week"
+	pageData.NoResults = len(pageData.Notes) == 0
+	renderPage(w, r, http.StatusOK, "index.html", pageData)
+}
+
+// calendarDay is one cell of the calendar grid. Padding cells outside the month
+// have a zero Day.
+type calendarDay struct {
+	Date  string
+	Day   int
+	Notes []Note
+}
+
+// calendarHandler renders a month (?month=YYYY-MM, defaulting to the current one) as a
+// grid of weeks starting on Monday, listing each day's notes by their date keyword.
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	if v := r.URL.Query().Get("month"); v != "" {
+		t, err := time.ParseInLocation("2006-01", v, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		month = t
+	}
+
+	notes, err := notesByDateKeyword(month.Format("2006-01"))
+	if err != nil {
+		log.Printf("Error querying notes for calendar of %s: %v", month.Format("2006-01"), err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+
+	var weeks [][]calendarDay
+	week := make([]calendarDay, (int(month.Weekday())+6)%7)
+	for d := month; d.Month() == month.Month(); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		week = append(week, calendarDay{Date: date, Day: d.Day(), Notes: notes[date]})
+		if len(week) == 7 {
+			weeks = append(weeks, week)
+			week = nil
+		}
+	}
+	if len(week) > 0 {
+		weeks = append(weeks, append(week, make([]calendarDay, 7-len(week))...))
+	}
+
+	pageData := struct {
+		Month      string
+		Prev, Next string
+		Weeks      [][]calendarDay
+	}{
+		Month: month.Format("January 2006"),
+		Prev:  month.AddDate(0, -1, 0).Format("2006-01"),
+		Next:  month.AddDate(0, 1, 0).Format("2006-01"),
+		Weeks: weeks,
+	}
+	renderPage(w, r, http.StatusOK, "calendar.html", pageData)
+}
+
+// digestHandler renders a plain-text summary of the notes created on a given day
+// (?date=YYYY-MM-DD, defaulting to today), suitable for mailing from a cron job.
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if v := r.URL.Query().Get("date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = t
+	}
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 1)
+
+	notes, err := notesCreatedBetween(from, to)
+	if err != nil {
+		log.Printf("Error querying notes for digest of %s: %v", from.Format("2006-01-02"), err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Notes for %s (%d)\n", from.Format("2006-01-02"), len(notes))
+	for _, n := range notes {
+		fmt.Fprintf(&b, "\n[%s] %s\n", n.Note.CreatedAt.Format("15:04"), n.Note.Content)
+		if len(n.Keywords) > 0 {
+			names := make([]string, len(n.Keywords))
+			for i, k := range n.Keywords {
+				names[i] = k.Name
+			}
+			fmt.Fprintf(&b, "Keywords: %s\n", strings.Join(names, ", "))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// lockPreventsDelete reports whether locked notes are also protected from deletion,
+// configurable via LOCK_PREVENTS_DELETE. By default they can still be deleted.
+func lockPreventsDelete() bool {
+	return envBool("LOCK_PREVENTS_DELETE")
+}
+
+// toggleLockHandler locks or unlocks a note and redirects back to it.
+func toggleLockHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	res, err := db.Exec("UPDATE notes SET locked = NOT locked WHERE id = ?", noteID)
+	if err != nil {
+		log.Printf("Error toggling lock of note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
+
+// toggleStarHandler stars or unstars a note and redirects back to it.
+func toggleStarHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	res, err := db.Exec("UPDATE notes SET starred = NOT starred WHERE id = ?", noteID)
+	if err != nil {
+		log.Printf("Error toggling star of note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
+
+// touchNoteHandler brings a note back to the top of the notes list sorted by
+// ?sort=active without changing it; its creation time is kept.
+func touchNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	res, err := db.Exec("UPDATE notes SET bumped_at = ? WHERE id = ?", time.Now(), noteID)
+	if err != nil {
+		log.Printf("Error touching note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	setFlash(w, r, noteFlashes["touched"])
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
+
+// starredHandler lists the starred notes, newest first.
+func starredHandler(w http.ResponseWriter, r *http.Request) {
+	pageData, err := loadIndexPage("", 0, "n.starred")
+	if err != nil {
+		log.Printf("Error querying starred notes: %v", err)
+		http.Error(w, "Error fetching notes", http.StatusInternalServerError)
+		return
+	}
+	pageData.Heading = "Starred"
+	pageData.Filter = "starred"
+	pageData.NoResults = len(pageData.Notes) == 0
+	renderPage(w, r, http.StatusOK, "index.html", pageData)
+}
+
+// keywordChangeQuery encodes which automatically extracted keywords were new and how
+// many existing ones were reused, for keywordChangeFlash on the page redirected to.
+func keywordChangeQuery(added []string, reused int) string {
+	q := url.Values{"added": added}
+	q.Set("reused", strconv.Itoa(reused))
+	return "?" + q.Encode()
+}
+
+// keywordChangeFlash describes the outcome of keyword extraction reported by
+// keywordChangeQuery, or returns "" if the query has none.
+func keywordChangeFlash(q url.Values) string {
+	if !q.Has("reused") {
+		return ""
+	}
+	added := q["added"]
+	reused, _ := strconv.Atoi(q.Get("reused"))
+	switch {
+	case len(added) > 0 && reused > 0:
+		return fmt.Sprintf("Added %d new keyword(s): %s. Reused %d existing keyword(s).", len(added), strings.Join(added, ", "), reused)
+	case len(added) > 0:
+		return fmt.Sprintf("Added %d new keyword(s): %s.", len(added), strings.Join(added, ", "))
+	case reused > 0:
+		return fmt.Sprintf("No new keywords; reused %d existing keyword(s).", reused)
+	}
+	return "No keywords were found for the note."
+}
+
+// noteFlashes are the messages shown on a note page after the actions they are keyed by.
+var noteFlashes = map[string]string{
+	"retagged":     "Keywords regenerated.",
+	"retag-failed": "Could not regenerate keywords; the previous keywords were kept.",
+	"ai-disabled":  "AI features are not configured.",
+	"touched":      "Moved to the top of the recently active notes.",
+}
+
+// retagNoteHandler replaces a note's keywords with freshly extracted ones and
+// redirects back to the note with a flash message reporting the outcome.
+func retagNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	var content string
+	var locked bool
+	err := db.QueryRow("SELECT content, locked FROM notes WHERE id = ?", noteID).Scan(decoded(&content), &locked)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for retagging: %v", noteID, err)
+		http.Error(w, "Error fetching note", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "This note is locked and cannot be edited", http.StatusForbidden)
+		return
+	}
+
+	flash := "retagged"
+	if !aiEnabled {
+		flash = "ai-disabled"
+	} else if err := retagNote(r.Context(), noteID, content); err != nil {
+		logAIError("Error retagging note "+noteID, err)
+		flash = "retag-failed"
+	}
+	setFlash(w, r, noteFlashes[flash])
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusSeeOther)
+}
+
+// shareNoteHandler gives a note a new random share token, replacing any previous
+// one, and redirects back to the note where the share link is shown.
+func shareNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating share token for note %s: %v", noteID, err)
+		http.Error(w, "Error sharing note", http.StatusInternalServerError)
+		return
+	}
+	res, err := db.Exec("UPDATE notes SET share_token = ? WHERE id = ?", hex.EncodeToString(buf), noteID)
+	if err != nil {
+		log.Printf("Error sharing note %s: %v", noteID, err)
+		http.Error(w, "Error sharing note", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
+
+// unshareNoteHandler revokes a note's share link by clearing its token.
+func unshareNoteHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	res, err := db.Exec("UPDATE notes SET share_token = NULL WHERE id = ?", noteID)
+	if err != nil {
+		log.Printf("Error unsharing note %s: %v", noteID, err)
+		http.Error(w, "Error unsharing note", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, r)
 		return
 	}
-	keyword := parts[2]
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
+
+// bulkDeleteHandler deletes the notes whose IDs are submitted as id form values,
+// together with their keyword links, in the request's transaction. Unknown IDs are
+// skipped, as are locked notes when LOCK_PREVENTS_DELETE is set.
+func bulkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	ids := r.PostForm["id"]
+	if len(ids) == 0 {
+		http.Error(w, "No notes selected", http.StatusBadRequest)
+		return
+	}
+
+	query := "DELETE FROM notes WHERE id = ?"
+	if lockPreventsDelete() {
+		query += " AND NOT locked"
+	}
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error deleting notes", http.StatusInternalServerError)
+		return
+	}
+	deleted := 0
+	for _, id := range ids {
+		res, err := tx.Exec(query, id)
+		if err != nil {
+			log.Printf("Error deleting note %s: %v", id, err)
+			http.Error(w, "Error deleting notes", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM note_keywords WHERE note_id = ?", id); err != nil {
+			log.Printf("Error deleting keyword links of note %s: %v", id, err)
+			http.Error(w, "Error deleting notes", http.StatusInternalServerError)
+			return
+		}
+		fireNoteDeletedWebhook(r.Context(), id)
+		deleted++
+	}
+	http.Redirect(w, r, fmt.Sprintf("/?deleted=%d", deleted), http.StatusSeeOther)
+}
+
+// noteMergeSeparator is placed between the contents of two merged notes.
+const noteMergeSeparator = "\n\n---\n\n"
+
+// mergeNotesHandler appends a secondary note to a primary one, moves its keywords
+// over and deletes the secondary, all in the request's transaction.
+func mergeNotesHandler(w http.ResponseWriter, r *http.Request) {
+	primaryID := strings.TrimSpace(r.FormValue("primary"))
+	secondaryID := strings.TrimSpace(r.FormValue("secondary"))
+	if primaryID == "" || secondaryID == "" {
+		http.Error(w, "Both primary and secondary note IDs are required", http.StatusBadRequest)
+		return
+	}
+	if primaryID == secondaryID {
+		http.Error(w, "Cannot merge a note with itself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	var primaryContent, secondaryContent string
+	var primaryLocked, secondaryLocked bool
+	if err := tx.QueryRow("SELECT content, locked FROM notes WHERE id = ?", primaryID).Scan(decoded(&primaryContent), &primaryLocked); err == sql.ErrNoRows {
+		http.Error(w, "Primary note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for merge: %v", primaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.QueryRow("SELECT content, locked FROM notes WHERE id = ?", secondaryID).Scan(decoded(&secondaryContent), &secondaryLocked); err == sql.ErrNoRows {
+		http.Error(w, "Secondary note not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for merge: %v", secondaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	// Merging edits the primary note and deletes the secondary one
+	if primaryLocked {
+		http.Error(w, "The primary note is locked and cannot be edited", http.StatusForbidden)
+		return
+	}
+	if secondaryLocked && lockPreventsDelete() {
+		http.Error(w, "The secondary note is locked and cannot be deleted", http.StatusForbidden)
+		return
+	}
+
+	merged, err := encodeContent(primaryContent + noteMergeSeparator + secondaryContent)
+	if err != nil {
+		log.Printf("Error encoding note %s during merge: %v", primaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE notes SET content = ? WHERE id = ?", merged, primaryID); err != nil {
+		log.Printf("Error updating note %s during merge: %v", primaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(
+		"INSERT OR IGNORE INTO note_keywords(note_id, keyword_id, source) SELECT ?, keyword_id, source FROM note_keywords WHERE note_id = ?",
+		primaryID, secondaryID,
+	); err != nil {
+		log.Printf("Error copying keywords from note %s to %s: %v", secondaryID, primaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM note_keywords WHERE note_id = ?", secondaryID); err != nil {
+		log.Printf("Error clearing keywords for note %s: %v", secondaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM notes WHERE id = ?", secondaryID); err != nil {
+		log.Printf("Error deleting merged note %s: %v", secondaryID, err)
+		http.Error(w, "Error merging notes", http.StatusInternalServerError)
+		return
+	}
+	fireNoteWebhook(r.Context(), tx, eventNoteUpdated, primaryID)
+	fireNoteDeletedWebhook(r.Context(), secondaryID)
+
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", primaryID), http.StatusFound)
+}
+
+// faviconHandler answers browser favicon requests without touching the database.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON encodes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// apiKeywordsHandler returns all keywords with their note counts as JSON, most used
+// first. An optional ?minCount= hides keywords used on fewer notes.
+func apiKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	minCount := 0
+	if v := r.URL.Query().Get("minCount"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "minCount must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		minCount = n
+	}
+
+	usage, err := keywordUsage(minCount)
+	if err != nil {
+		log.Printf("Error querying keyword usage: %v", err)
+		http.Error(w, "Error fetching keywords", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// suggestKeywordsHandler returns the keywords a note with the posted content would
+// get if saved with an empty keywords field, without saving anything. Date keywords
+// are included even when the AI call fails or AI is off. The response also carries
+// the suggestions formatted for the keywords field.
+func suggestKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	content := normalizeContent(r.FormValue("content"))
+	if content == "" {
+		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
+		return
+	}
+	keywords := mergeKeywords(linkNames(autoKeywords(r.Context(), content)), defaultKeywords())
+	if keywords == nil {
+		keywords = []string{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Keywords []string `json:"keywords"`
+		Input    string   `json:"input"`
+	}{keywords, formatKeywordInput(keywords)})
+}
+
+// statsHandler reports as JSON how keywords got onto notes and how many AI keywords
+// were kept versus removed by hand. The acceptance rate is null until there is data.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	bySource := make(map[string]int)
+	rows, err := db.Query("SELECT source, COUNT(*) FROM note_keywords GROUP BY source")
+	if err != nil {
+		log.Printf("Error querying keyword sources: %v", err)
+		http.Error(w, "Error fetching stats", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var source string
+		var count int
+		if err := rows.Scan(&source, &count); err != nil {
+			log.Printf("Error scanning keyword source: %v", err)
+			http.Error(w, "Error fetching stats", http.StatusInternalServerError)
+			return
+		}
+		bySource[source] = count
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating keyword sources: %v", err)
+		http.Error(w, "Error fetching stats", http.StatusInternalServerError)
+		return
+	}
+
+	var removed int
+	if err := db.QueryRow("SELECT COUNT(*) FROM keyword_removals WHERE source = ?", sourceAI).Scan(&removed); err != nil {
+		log.Printf("Error counting removed keywords: %v", err)
+		http.Error(w, "Error fetching stats", http.StatusInternalServerError)
+		return
+	}
+	kept := bySource[sourceAI]
+	var rate *float64
+	if kept+removed > 0 {
+		v := float64(kept) / float64(kept+removed)
+		rate = &v
+	}
+	writeJSON(w, http.StatusOK, struct {
+		KeywordsBySource map[string]int `json:"keywordsBySource"`
+		AIKept           int            `json:"aiKept"`
+		AIRemoved        int            `json:"aiRemoved"`
+		AIAcceptanceRate *float64       `json:"aiAcceptanceRate"`
+	}{bySource, kept, removed, rate})
+}
+
+// listKeywordsHandler displays a page with all available keywords and their note
+// counts, sorted by ?sort=name (the default), count or recent.
+func listKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	order, ok := keywordSortOrders[sortBy]
+	if !ok {
+		http.Error(w, "sort must be one of name, count or recent", http.StatusBadRequest)
+		return
+	}
+	// The order clause comes from keywordSortOrders, never from the request
+	rows, err := db.Query(
+		`SELECT k.name, COUNT(nk.note_id) AS uses
+		 FROM keywords k
+		 LEFT JOIN note_keywords nk ON nk.keyword_id = k.id
+		 LEFT JOIN notes n ON n.id = nk.note_id
+		 GROUP BY k.id
+		 ORDER BY ` + order,
+	)
+	if err != nil {
+		log.Printf("Error querying keywords: %v", err)
+		http.Error(w, "Error fetching keywords", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var keywords []KeywordUsage
+	for rows.Next() {
+		var k KeywordUsage
+		if err := rows.Scan(&k.Name, &k.Count); err != nil {
+			log.Printf("Error scanning keyword: %v", err)
+			continue
+		}
+		keywords = append(keywords, k)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Keyword row iteration error: %v", err)
+	}
+
+	data := struct {
+		Keywords []KeywordUsage
+		Sort     string
+	}{keywords, sortBy}
+	if err := templates.Load().ExecuteTemplate(w, "keywords.html", data); err != nil {
+		log.Printf("Error executing keywords template: %v", err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	}
+}
+
+// orphanKeywordsHandler lists, as JSON, the keywords that are not linked to any note.
+func orphanKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT name FROM keywords WHERE id NOT IN (SELECT keyword_id FROM note_keywords) ORDER BY name")
+	if err != nil {
+		log.Printf("Error querying orphaned keywords: %v", err)
+		http.Error(w, "Error fetching keywords", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orphans := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("Error scanning orphaned keyword: %v", err)
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Orphaned keyword row iteration error: %v", err)
+	}
+	writeJSON(w, http.StatusOK, orphans)
+}
+
+// pruneKeywordsHandler deletes all keywords that are not linked to any note and
+// reports how many were removed.
+func pruneKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	res, err := db.Exec("DELETE FROM keywords WHERE id NOT IN (SELECT keyword_id FROM note_keywords)")
+	if err != nil {
+		log.Printf("Error pruning orphaned keywords: %v", err)
+		http.Error(w, "Error pruning keywords", http.StatusInternalServerError)
+		return
+	}
+	removed, _ := res.RowsAffected()
+	log.Printf("Pruned %d orphaned keyword(s)", removed)
+	writeJSON(w, http.StatusOK, struct {
+		Removed int64 `json:"removed"`
+	}{Removed: removed})
+}
+
+// dedupeKeywordsHandler asks the model to group existing keywords that mean the same
+// thing and returns the proposed merges as JSON. Nothing is changed; each proposal
+// carries a pattern to confirm it with through /keywords/merge-by-pattern.
+func dedupeKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	if !aiEnabled {
+		http.Error(w, "AI features are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	names, err := keywordCandidates("")
+	if err != nil {
+		log.Printf("Error querying keywords for deduplication: %v", err)
+		http.Error(w, "Error fetching keywords", http.StatusInternalServerError)
+		return
+	}
+	groups, err := groupSynonymKeywords(r.Context(), names)
+	if err != nil {
+		logAIError("Error grouping synonym keywords", err)
+		http.Error(w, "Error finding duplicate keywords", http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Groups []keywordGroup `json:"groups"`
+	}{Groups: groups})
+}
 
-	// Query notes filtered by keyword
+// renameKeywordHandler renames a keyword to the posted "name", for inline editing on
+// the keywords page. If a keyword with the new name exists, the two are merged. The
+// response is {"name": "...", "merged": bool, "count": N}, where count is the number
+// of notes the keyword is now on.
+func renameKeywordHandler(w http.ResponseWriter, r *http.Request) {
+	oldName := r.PathValue("name")
+	newName := strings.TrimSpace(r.FormValue("name"))
+	if newName == "" {
+		http.Error(w, "A new name is required", http.StatusBadRequest)
+		return
+	}
+	if reason := keywordDropReason(newName); reason != "" {
+		http.Error(w, fmt.Sprintf("%q cannot be a keyword because %s", newName, reason), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+		return
+	}
+	var oldID int
+	if err := tx.QueryRow("SELECT id FROM keywords WHERE name = ?", oldName).Scan(&oldID); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying keyword %q for rename: %v", oldName, err)
+		http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+		return
+	}
+	targetID := oldID
+	merged := false
+	if newName != oldName {
+		err := tx.QueryRow("SELECT id FROM keywords WHERE name = ?", newName).Scan(&targetID)
+		switch {
+		case err == sql.ErrNoRows:
+			targetID = oldID
+			if _, err := tx.Exec("UPDATE keywords SET name = ? WHERE id = ?", newName, oldID); err != nil {
+				log.Printf("Error renaming keyword %q to %q: %v", oldName, newName, err)
+				http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+				return
+			}
+		case err != nil:
+			log.Printf("Error querying keyword %q for rename: %v", newName, err)
+			http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+			return
+		default:
+			if err := mergeKeywordInto(tx, oldID, targetID); err != nil {
+				log.Printf("Error merging keyword %q into %q: %v", oldName, newName, err)
+				http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+				return
+			}
+			merged = true
+		}
+		log.Printf("Renamed keyword %q to %q (merged: %t)", oldName, newName, merged)
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM note_keywords WHERE keyword_id = ?", targetID).Scan(&count); err != nil {
+		log.Printf("Error counting notes of keyword %q: %v", newName, err)
+		http.Error(w, "Error renaming keyword", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Name   string `json:"name"`
+		Merged bool   `json:"merged"`
+		Count  int    `json:"count"`
+	}{newName, merged, count})
+}
+
+// mergeKeywordsByPatternHandler moves the notes of every keyword whose name matches
+// the pattern regex over to the target keyword and deletes the matched keywords, all
+// in the request's transaction. It reports how many keywords were merged.
+func mergeKeywordsByPatternHandler(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimSpace(r.FormValue("target"))
+	if target == "" {
+		http.Error(w, "A target keyword is required", http.StatusBadRequest)
+		return
+	}
+	pattern, err := regexp.Compile(r.FormValue("pattern"))
+	if err != nil || r.FormValue("pattern") == "" {
+		http.Error(w, "A valid pattern regex is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+		return
+	}
+	rows, err := tx.Query("SELECT id, name FROM keywords")
+	if err != nil {
+		log.Printf("Error querying keywords for merge: %v", err)
+		http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+		return
+	}
+	var matched []int
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			log.Printf("Error scanning keyword for merge: %v", err)
+			http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+			return
+		}
+		if name != target && pattern.MatchString(name) {
+			matched = append(matched, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Keyword row iteration error during merge: %v", err)
+		http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+		return
+	}
+	if len(matched) == 0 {
+		http.Error(w, "The pattern matches no keywords", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", target); err != nil {
+		log.Printf("Error creating keyword %q: %v", target, err)
+		http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+		return
+	}
+	var targetID int
+	if err := tx.QueryRow("SELECT id FROM keywords WHERE name = ?", target).Scan(&targetID); err != nil {
+		log.Printf("Error retrieving keyword ID for %q: %v", target, err)
+		http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range matched {
+		if err := mergeKeywordInto(tx, id, targetID); err != nil {
+			log.Printf("Error merging keyword %d into %q: %v", id, target, err)
+			http.Error(w, "Error merging keywords", http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("Merged %d keyword(s) matching %q into %q", len(matched), pattern, target)
+	writeJSON(w, http.StatusOK, struct {
+		Merged int `json:"merged"`
+	}{Merged: len(matched)})
+}
+
+// notesByKeywordHandler displays notes associated with a specific keyword
+func notesByKeywordHandler(w http.ResponseWriter, r *http.Request) {
+	keyword := r.PathValue("keyword")
+	sortBy, orderBy, ok := noteOrder(r.URL.Query().Get("sort"))
+	if !ok {
+		http.Error(w, "sort must be one of "+noteSortNames(), http.StatusBadRequest)
+		return
+	}
+
+	// Query notes filtered by keyword; NOCASE matching only folds ASCII letters
 	rows, err := db.Query(
-		`SELECT n.id, n.content, n.created_at
+		`SELECT n.id, n.content, n.created_at, n.starred
 		 FROM notes n
 		 JOIN note_keywords nk ON n.id = nk.note_id
 		 JOIN keywords k ON nk.keyword_id = k.id
-		 WHERE k.name = ?
-		 ORDER BY n.created_at DESC`,
-		keyword,
+		 WHERE k.name = ? COLLATE NOCASE AND (n.expires_at IS NULL OR n.expires_at > ?)
+		 ORDER BY `+orderBy,
+		keyword, time.Now(),
 	)
 	if err != nil {
 		log.Printf("Error querying notes for keyword %q: %v", keyword, err)
@@ -481,12 +1845,13 @@ func notesByKeywordHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var id, content string
 		var createdAt time.Time
-		if err := rows.Scan(&id, &content, &createdAt); err != nil {
+		var starred bool
+		if err := rows.Scan(&id, decoded(&content), &createdAt, &starred); err != nil {
 			log.Printf("Error scanning note row for keyword %q: %v", keyword, err)
 			continue
 		}
 		if _, exists := noteMap[id]; !exists {
-			noteMap[id] = &NoteWithKeywords{Note: Note{ID: id, Content: content, CreatedAt: createdAt}}
+			noteMap[id] = &NoteWithKeywords{Note: Note{ID: id, Content: content, CreatedAt: createdAt, Starred: starred}}
 			order = append(order, id)
 		}
 	}
@@ -500,66 +1865,83 @@ func notesByKeywordHandler(w http.ResponseWriter, r *http.Request) {
 		notes = append(notes, *noteMap[id])
 	}
 
-	// Retrieve note-level keywords for each filtered note
+	// Retrieve note-level keywords for all filtered notes at once
+	noteKeywords, err := keywordsForNotes(order)
+	if err != nil {
+		log.Printf("Error querying keywords for notes with keyword %q: %v", keyword, err)
+	}
 	for i := range notes {
-		nid := notes[i].Note.ID
-		krows2, kerr2 := db.Query(
-			"SELECT k.name FROM keywords k JOIN note_keywords nk ON k.id = nk.keyword_id WHERE nk.note_id = ?",
-			nid,
-		)
-		if kerr2 != nil {
-			log.Printf("Error querying keywords for note %s: %v", nid, kerr2)
-			continue
-		}
-		for krows2.Next() {
-			var k Keyword
-			if err := krows2.Scan(&k.Name); err != nil {
-				log.Printf("Error scanning keyword for note %s: %v", nid, err)
-				continue
-			}
-			notes[i].Keywords = append(notes[i].Keywords, k)
-		}
-		krows2.Close()
-		if cerr2 := krows2.Err(); cerr2 != nil {
-			log.Printf("Keyword row iteration error for note %s: %v", nid, cerr2)
-		}
+		notes[i].Keywords = noteKeywords[notes[i].Note.ID]
 	}
 
-	// Retrieve all keywords for filter list
-	kwRows, err := db.Query("SELECT name FROM keywords ORDER BY name")
+	// Retrieve the most used keywords for the filter list
+	allKeywords, moreKeywords := sidebarKeywords()
+
+	related, err := relatedKeywords(keyword)
 	if err != nil {
-		log.Printf("Error querying keywords: %v", err)
+		log.Printf("Error querying related keywords for %q: %v", keyword, err)
 	}
-	defer func() {
-		if kwRows != nil {
-			kwRows.Close()
-		}
-	}()
-	var allKeywords []Keyword
-	for kwRows != nil && kwRows.Next() {
-		var k Keyword
-		if err := kwRows.Scan(&k.Name); err != nil {
-			log.Printf("Error scanning keyword: %v", err)
-			continue
-		}
-		allKeywords = append(allKeywords, k)
+
+	pageData := indexPageData{
+		Notes:         notes,
+		Keywords:      allKeywords,
+		MoreKeywords:  moreKeywords,
+		ActiveKeyword: keyword,
+		Related:       related,
+		Filter:        keyword,
+		NoResults:     len(notes) == 0,
+		Sort:          sortBy,
 	}
-	if kwRows != nil {
-		if err := kwRows.Err(); err != nil {
-			log.Printf("Keyword row iteration error: %v", err)
+
+	renderPage(w, r, http.StatusOK, "index.html", pageData)
+}
+
+// relatedKeywords returns the keywords that share notes with the given keyword,
+// ranked by how many notes they have in common. The keyword itself is excluded.
+func relatedKeywords(keyword string) ([]KeywordUsage, error) {
+	rows, err := db.Query(
+		`SELECT k2.name, COUNT(DISTINCT nk1.note_id) AS shared
+		 FROM keywords k1
+		 JOIN note_keywords nk1 ON nk1.keyword_id = k1.id
+		 JOIN note_keywords nk2 ON nk2.note_id = nk1.note_id AND nk2.keyword_id != nk1.keyword_id
+		 JOIN keywords k2 ON k2.id = nk2.keyword_id
+		 WHERE k1.name = ? COLLATE NOCASE AND k2.name != k1.name COLLATE NOCASE
+		 GROUP BY k2.id
+		 ORDER BY shared DESC, k2.name`,
+		keyword,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var related []KeywordUsage
+	for rows.Next() {
+		var k KeywordUsage
+		if err := rows.Scan(&k.Name, &k.Count); err != nil {
+			return nil, err
 		}
+		related = append(related, k)
 	}
+	return related, rows.Err()
+}
 
-	pageData := struct {
-		Notes    []NoteWithKeywords
-		Keywords []Keyword
-	}{
-		Notes:    notes,
-		Keywords: allKeywords,
+// relatedKeywordsHandler displays the keywords that co-occur with a given keyword
+func relatedKeywordsHandler(w http.ResponseWriter, r *http.Request) {
+	keyword := r.PathValue("keyword")
+	related, err := relatedKeywords(keyword)
+	if err != nil {
+		log.Printf("Error querying related keywords for %q: %v", keyword, err)
+		http.Error(w, "Error fetching related keywords", http.StatusInternalServerError)
+		return
 	}
 
-	if err := templates.ExecuteTemplate(w, "index.html", pageData); err != nil {
-		log.Printf("Error executing index template: %v", err)
-		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+	pageData := struct {
+		Keyword string
+		Related []KeywordUsage
+	}{
+		Keyword: keyword,
+		Related: related,
 	}
+	renderPage(w, r, http.StatusOK, "related_keywords.html", pageData)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotesByKeywordIgnoresCase(t *testing.T) {
+	setupTestDB(t)
+	createTestNote(t, "Husleie og strøm", keywordLink{Name: "budsjett", Source: sourceManual})
+	createTestNote(t, "Something else", keywordLink{Name: "other", Source: sourceManual})
+
+	for _, keyword := range []string{"budsjett", "Budsjett", "BUDSJETT"} {
+		t.Run(keyword, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/keyword/"+keyword, nil)
+			r.SetPathValue("keyword", keyword)
+			w := httptest.NewRecorder()
+			notesByKeywordHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, "Husleie og strøm") {
+				t.Errorf("note tagged budsjett is missing for /keyword/%s", keyword)
+			}
+			if strings.Contains(body, "Something else") {
+				t.Errorf("note with another keyword is listed for /keyword/%s", keyword)
+			}
+		})
+	}
+}
+
+func TestCreateNoteRequireKeywords(t *testing.T) {
+	setupTestDB(t)
+	initStopwords()
+	t.Setenv("REQUIRE_KEYWORDS", "1")
+	t.Setenv("DEFAULT_KEYWORDS", "inbox")
+	t.Setenv("DATE_KEYWORD_GRANULARITIES", "")
+
+	tests := []struct {
+		name, content, keywords string
+		want                    int
+	}{
+		// The default keyword alone does not count
+		{"only defaults", "Nothing to tag here", "", http.StatusBadRequest},
+		{"only stopwords", "Typed filler", "the, a", http.StatusBadRequest},
+		{"no keywords", "Explicitly untagged", "-", http.StatusBadRequest},
+		{"typed", "Typed keyword", "project", http.StatusFound},
+		{"date", "Due 2025-06-15", "", http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"content": {tt.content}, "keywords": {tt.keywords}}
+			r := httptest.NewRequest(http.MethodPost, "/notes/create", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			withTx(createNoteHandler)(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusBadRequest && !strings.Contains(w.Body.String(), tt.content) {
+				t.Errorf("content %q is not kept in the re-rendered form", tt.content)
+			}
+		})
+	}
+}
+
+func TestCreateNoteConcurrently(t *testing.T) {
+	setupTestDB(t)
+	const n = 40
+	codes := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each create reads before it writes, which deferred transactions cannot
+			// upgrade to a write lock without running into each other
+			form := url.Values{"content": {fmt.Sprintf("Note %d", i)}, "keywords": {fmt.Sprintf("shared, mine%d", i)}, "idempotency_key": {fmt.Sprintf("key-%d", i)}}
+			r := httptest.NewRequest(http.MethodPost, "/notes/create", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			withTx(createNoteHandler)(w, r)
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusFound {
+			t.Errorf("request %d: status = %d, want %d", i, code, http.StatusFound)
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("%d notes saved, want %d", count, n)
+	}
+}
+
+func TestCreateNoteRepeatedKey(t *testing.T) {
+	setupTestDB(t)
+	calls := stubOpenAI(t, `{"keywords": ["groceries"]}`)
+
+	var locations []string
+	for range 2 {
+		form := url.Values{"content": {"Buy milk"}, "idempotency_key": {"same"}}
+		r := httptest.NewRequest(http.MethodPost, "/notes/create", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		withTx(createNoteHandler)(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusFound)
+		}
+		locations = append(locations, w.Header().Get("Location"))
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("%d OpenAI calls for a repeated submission, want 1", n)
+	}
+	if locations[0] == "/" || locations[1] != locations[0] {
+		t.Errorf("redirects = %q, want the keyword message repeated", locations)
+	}
+}
+
+func TestUpdateLockedNoteSkipsExtraction(t *testing.T) {
+	setupTestDB(t)
+	calls := stubOpenAI(t, `{"keywords": ["groceries"]}`)
+	noteID := createTestNote(t, "Buy milk")
+	if _, err := db.Exec("UPDATE notes SET locked = 1 WHERE id = ?", noteID); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[string]int{noteID: http.StatusForbidden, "999999": http.StatusNotFound} {
+		form := url.Values{"content": {"Buy oat milk"}}
+		r := httptest.NewRequest(http.MethodPost, "/notes/"+id+"/edit", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		withTx(updateNoteHandler)(w, r)
+		if w.Code != want {
+			t.Errorf("note %s: status = %d, want %d", id, w.Code, want)
+		}
+	}
+
+	if n := calls.Load(); n != 0 {
+		t.Errorf("%d OpenAI calls for refused edits, want 0", n)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// idempotencyKey returns the client-supplied key for a create request, taken from
+// the Idempotency-Key header or the idempotency_key form field, or "" if none.
+func idempotencyKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("Idempotency-Key")); key != "" {
+		return key
+	}
+	return strings.TrimSpace(r.FormValue("idempotency_key"))
+}
+
+// idempotencyTTL is how long a key keeps returning the note it created.
+func idempotencyTTL() time.Duration {
+	return envDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+}
+
+// queryRower runs single-row queries; both *sql.DB and *sql.Tx implement it.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// noteForIdempotencyKey returns the ID of the note created with key within the TTL,
+// and where the request that created it was redirected, or "" if the key is new.
+// Without a transaction, q can be db for a quick check before any lock is taken.
+func noteForIdempotencyKey(q queryRower, key string) (noteID, redirect string, err error) {
+	var stored sql.NullString
+	err = q.QueryRow(
+		"SELECT note_id, redirect FROM idempotency_keys WHERE key = ? AND created_at > ?",
+		key, time.Now().Add(-idempotencyTTL()),
+	).Scan(&noteID, &stored)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return noteID, stored.String, err
+}
+
+// storeIdempotencyKey records that key created the note and where the request was
+// redirected, replacing an expired entry.
+func storeIdempotencyKey(tx *sql.Tx, key, noteID, redirect string) error {
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO idempotency_keys(key, note_id, redirect, created_at) VALUES(?, ?, ?, ?)",
+		key, noteID, redirect, time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runExpiryJanitor periodically deletes notes whose expiry time has passed, along
+// with idempotency keys older than their TTL and idle sessions. It returns when ctx
+// is canceled.
+func runExpiryJanitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		deleteExpiredNotes()
+		deleteExpiredIdempotencyKeys()
+		deleteExpiredSessions()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteExpiredNotes removes expired notes and their keyword links.
+func deleteExpiredNotes() {
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting expiry transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"DELETE FROM note_keywords WHERE note_id IN (SELECT id FROM notes WHERE expires_at IS NOT NULL AND expires_at <= ?)",
+		now,
+	); err != nil {
+		log.Printf("Error deleting keyword links of expired notes: %v", err)
+		return
+	}
+	res, err := tx.Exec("DELETE FROM notes WHERE expires_at IS NOT NULL AND expires_at <= ?", now)
+	if err != nil {
+		log.Printf("Error deleting expired notes: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing expiry transaction: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Deleted %d expired note(s)", n)
+	}
+}
+
+// deleteExpiredIdempotencyKeys removes idempotency keys that no longer deduplicate.
+func deleteExpiredIdempotencyKeys() {
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at <= ?", time.Now().Add(-idempotencyTTL())); err != nil {
+		log.Printf("Error deleting expired idempotency keys: %v", err)
+	}
+}
+
+// deleteExpiredSessions removes sessions idle for longer than SESSION_IDLE_TIMEOUT.
+func deleteExpiredSessions() {
+	if _, err := db.Exec("DELETE FROM sessions WHERE last_seen <= ?", time.Now().Add(-sessionIdleTimeout())); err != nil {
+		log.Printf("Error deleting expired sessions: %v", err)
+	}
+}
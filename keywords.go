@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// keywordDelimiters maps the accepted KEYWORD_DELIMITER names to their separators.
+var keywordDelimiters = map[string]string{
+	"comma":     ",",
+	"semicolon": ";",
+	"newline":   "\n",
+}
+
+// keywordDelimiterName is the configured name of the keyword form delimiter, set by
+// initKeywordDelimiter.
+var keywordDelimiterName = "comma"
+
+// initKeywordDelimiter reads KEYWORD_DELIMITER, falling back to comma when it is unset
+// or not one of the accepted names.
+func initKeywordDelimiter() {
+	v := os.Getenv("KEYWORD_DELIMITER")
+	if v == "" {
+		return
+	}
+	if _, ok := keywordDelimiters[v]; !ok {
+		log.Printf("Invalid KEYWORD_DELIMITER %q, using default comma", v)
+		return
+	}
+	keywordDelimiterName = v
+}
+
+// parseKeywordInput splits keyword form input on the configured delimiter into trimmed,
+// non-empty names.
+func parseKeywordInput(input string) []string {
+	return splitKeywords(input, keywordDelimiters[keywordDelimiterName])
+}
+
+// formatKeywordInput joins names with the configured delimiter, as the keywords form
+// field expects them.
+func formatKeywordInput(names []string) string {
+	if keywordDelimiterName == "newline" {
+		return strings.Join(names, "\n")
+	}
+	return strings.Join(names, keywordDelimiters[keywordDelimiterName]+" ")
+}
+
+// splitKeywords splits input on sep into trimmed, non-empty names.
+func splitKeywords(input, sep string) []string {
+	var names []string
+	for _, part := range strings.Split(input, sep) {
+		if name := strings.TrimSpace(part); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// noKeywordsInput is the keywords field value asking for a note without any keywords.
+const noKeywordsInput = "-"
+
+// wantsNoKeywords reports whether keyword form input asks for no keywords at all, in
+// which case extraction, date keywords and DEFAULT_KEYWORDS are all skipped.
+func wantsNoKeywords(input string) bool {
+	return strings.TrimSpace(input) == noKeywordsInput
+}
+
+// defaultKeywords returns the keywords from DEFAULT_KEYWORDS that every new note gets.
+// The variable is always comma-separated, independent of KEYWORD_DELIMITER.
+func defaultKeywords() []string {
+	return splitKeywords(os.Getenv("DEFAULT_KEYWORDS"), ",")
+}
+
+// mergeKeywords concatenates keyword lists, keeping the first occurrence of each name.
+func mergeKeywords(lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]struct{})
+	for _, list := range lists {
+		for _, name := range list {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// keywordCandidates returns the existing keywords offered to the model when extracting
+// keywords for content, most used first so established keywords are preferred for
+// reuse over new near-duplicates. Sending the whole table would grow the
+// prompt without bound, so it is limited to the OPENAI_MAX_EXISTING_KEYWORDS most used
+// keywords plus any others whose name appears in the content.
+func keywordCandidates(content string) ([]string, error) {
+	rows, err := db.Query(
+		`SELECT k.name
+		 FROM keywords k
+		 LEFT JOIN note_keywords nk ON nk.keyword_id = k.id
+		 GROUP BY k.id
+		 ORDER BY COUNT(nk.note_id) DESC, k.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limit := envInt("OPENAI_MAX_EXISTING_KEYWORDS", 500)
+	lower := strings.ToLower(content)
+	var names []string
+	total := 0
+	for ; rows.Next(); total++ {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if total < limit || strings.Contains(lower, strings.ToLower(name)) {
+			names = append(names, name)
+		}
+	}
+	debugf("Offering %d of %d existing keywords to the model (OPENAI_MAX_EXISTING_KEYWORDS=%d)", len(names), total, limit)
+	return names, rows.Err()
+}
+
+// splitNewKeywords separates the names that do not exist as keywords yet from those
+// that do, which are counted as reused. Names linkKeywords would drop are left out of
+// both. It must run before the keywords are linked.
+func splitNewKeywords(tx *sql.Tx, names []string) (added []string, reused int, err error) {
+	for _, name := range names {
+		if keywordDropReason(name) != "" {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM keywords WHERE name = ?)", name).Scan(&exists); err != nil {
+			return nil, 0, fmt.Errorf("failed to look up keyword %q: %v", name, err)
+		}
+		if exists {
+			reused++
+		} else {
+			added = append(added, name)
+		}
+	}
+	return added, reused, nil
+}
+
+// Sources of keyword links, recorded with each link to tell how the keyword came to
+// be on the note.
+const (
+	sourceManual   = "manual"   // typed into the keywords field
+	sourceAI       = "ai"       // extracted by the model
+	sourceFallback = "fallback" // frequent words, when the model could not be reached
+	sourceDate     = "date"     // a date found in the content
+	sourceDefault  = "default"  // from DEFAULT_KEYWORDS
+	sourceUnknown  = "unknown"  // linked before sources were recorded
+)
+
+// keywordSourceTitle describes a keyword source for a tooltip, or returns "" for
+// sources not worth pointing out.
+func keywordSourceTitle(source string) string {
+	switch source {
+	case sourceAI:
+		return "Suggested by AI"
+	case sourceFallback:
+		return "Frequent word, suggested while AI was unavailable"
+	case sourceDate:
+		return "Date found in the note"
+	case sourceDefault:
+		return "Default keyword"
+	}
+	return ""
+}
+
+// keywordLink is a keyword to link to a note, together with its source.
+type keywordLink struct {
+	Name   string
+	Source string
+}
+
+// linksFrom pairs each name with source.
+func linksFrom(source string, names []string) []keywordLink {
+	links := make([]keywordLink, 0, len(names))
+	for _, name := range names {
+		links = append(links, keywordLink{Name: name, Source: source})
+	}
+	return links
+}
+
+// linkNames returns the distinct keyword names of links in order.
+func linkNames(links []keywordLink) []string {
+	names := make([]string, 0, len(links))
+	for _, l := range links {
+		names = append(names, l.Name)
+	}
+	return mergeKeywords(names)
+}
+
+// keywordSources returns the keywords linked to a note, mapped to their sources.
+func keywordSources(tx *sql.Tx, noteID string) (map[string]string, error) {
+	rows, err := tx.Query(
+		"SELECT k.name, nk.source FROM note_keywords nk JOIN keywords k ON k.id = nk.keyword_id WHERE nk.note_id = ?",
+		noteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sources := make(map[string]string)
+	for rows.Next() {
+		var name, source string
+		if err := rows.Scan(&name, &source); err != nil {
+			return nil, err
+		}
+		sources[name] = source
+	}
+	return sources, rows.Err()
+}
+
+// recordRemovedAIKeywords logs and stores the AI keywords in previous, a note's old
+// keyword sources, that are missing from kept, the names it is saved with now. The
+// stored removals feed the AI keyword acceptance rate on /stats.
+func recordRemovedAIKeywords(tx *sql.Tx, noteID string, previous map[string]string, kept []string) error {
+	keep := make(map[string]bool, len(kept))
+	for _, name := range kept {
+		keep[name] = true
+	}
+	for name, source := range previous {
+		if source != sourceAI || keep[name] {
+			continue
+		}
+		log.Printf("AI keyword %q removed from note %s", name, noteID)
+		if _, err := tx.Exec(
+			"INSERT INTO keyword_removals(note_id, keyword, source, removed_at) VALUES(?, ?, ?, ?)",
+			noteID, name, source, time.Now(),
+		); err != nil {
+			return fmt.Errorf("failed to record removal of keyword %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// clearExtractedKeywords unlinks the AI, fallback and date keywords of a note so they
+// can be extracted again. Keywords typed in by hand, or added some other way, stay
+// linked.
+func clearExtractedKeywords(tx *sql.Tx, noteID string) error {
+	_, err := tx.Exec(
+		"DELETE FROM note_keywords WHERE note_id = ? AND source IN (?, ?, ?)",
+		noteID, sourceAI, sourceFallback, sourceDate,
+	)
+	return err
+}
+
+// linkDropReason returns why linkKeywords would skip link, or "" if it would be linked.
+func linkDropReason(link keywordLink) string {
+	// Dates are never filler, whatever the stopword list says
+	if link.Source == sourceDate {
+		return ""
+	}
+	return keywordDropReason(link.Name)
+}
+
+// errKeywordLimit is returned when creating a keyword would exceed MAX_KEYWORDS.
+var errKeywordLimit = errors.New("the maximum number of keywords has been reached")
+
+// linkKeywords creates any missing keywords and links them to the note within tx,
+// recording each link's source. A name listed twice keeps its first source. Stopwords
+// and too short names are skipped unless they are dates (see keywordDropReason). It
+// fails with errKeywordLimit if a new keyword would exceed MAX_KEYWORDS.
+func linkKeywords(ctx context.Context, tx *sql.Tx, noteID string, links []keywordLink) (err error) {
+	_, span := tracer.Start(ctx, "db.linkKeywords", trace.WithAttributes(attribute.Int("keywords.count", len(links))))
+	defer func() { endSpan(span, err) }()
+	maxKeywords := envInt("MAX_KEYWORDS", 0)
+	for _, link := range links {
+		name := link.Name
+		if reason := linkDropReason(link); reason != "" {
+			debugf("Not linking keyword %q to note %s: %s", name, noteID, reason)
+			continue
+		}
+		res, err := tx.Exec("INSERT OR IGNORE INTO keywords(name) VALUES(?)", name)
+		if err != nil {
+			return fmt.Errorf("failed to insert keyword %q: %v", name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 && maxKeywords > 0 {
+			var count int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM keywords").Scan(&count); err != nil {
+				return fmt.Errorf("failed to count keywords: %v", err)
+			}
+			if count > maxKeywords {
+				return errKeywordLimit
+			}
+		}
+		var kid int
+		if err := tx.QueryRow("SELECT id FROM keywords WHERE name = ?", name).Scan(&kid); err != nil {
+			return fmt.Errorf("failed to retrieve keyword ID for %q: %v", name, err)
+		}
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO note_keywords(note_id, keyword_id, source) VALUES(?, ?, ?)",
+			noteID, kid, link.Source,
+		); err != nil {
+			return fmt.Errorf("failed to link note %s with keyword %q: %v", noteID, name, err)
+		}
+	}
+	return nil
+}
+
+// mergeKeywordInto moves the notes of keyword fromID to keyword toID, keeping each
+// link's source, and deletes keyword fromID.
+func mergeKeywordInto(tx *sql.Tx, fromID, toID int) error {
+	if _, err := tx.Exec(
+		"INSERT OR IGNORE INTO note_keywords(note_id, keyword_id, source) SELECT note_id, ?, source FROM note_keywords WHERE keyword_id = ?",
+		toID, fromID,
+	); err != nil {
+		return fmt.Errorf("failed to move notes: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM note_keywords WHERE keyword_id = ?", fromID); err != nil {
+		return fmt.Errorf("failed to unlink keyword: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM keywords WHERE id = ?", fromID); err != nil {
+		return fmt.Errorf("failed to delete keyword: %v", err)
+	}
+	return nil
+}
+
+// keywordUsage returns keywords used on at least minCount notes, most used first.
+func keywordUsage(minCount int) ([]KeywordUsage, error) {
+	rows, err := db.Query(
+		`SELECT k.name, COUNT(nk.note_id) AS uses
+		 FROM keywords k
+		 LEFT JOIN note_keywords nk ON nk.keyword_id = k.id
+		 GROUP BY k.id
+		 HAVING uses >= ?
+		 ORDER BY uses DESC, k.name`,
+		minCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []KeywordUsage{}
+	for rows.Next() {
+		var k KeywordUsage
+		if err := rows.Scan(&k.Name, &k.Count); err != nil {
+			return nil, err
+		}
+		usage = append(usage, k)
+	}
+	return usage, rows.Err()
+}
+
+// keywordSortOrders maps the sort options of the keywords page to ORDER BY clauses
+// over its query. "recent" orders by each keyword's newest note; keywords without
+// notes have none and sort last.
+var keywordSortOrders = map[string]string{
+	"name":   "k.name",
+	"count":  "uses DESC, k.name",
+	"recent": "MAX(n.created_at) DESC, k.name",
+}
+
+// keywordsForNotes returns the keywords of each of the given notes, keyed by note ID,
+// using a single query. Duplicate IDs are queried once; no IDs means no query.
+func keywordsForNotes(ids []string) (map[string][]Keyword, error) {
+	result := make(map[string][]Keyword)
+	seen := make(map[string]bool)
+	var args []any
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			args = append(args, id)
+		}
+	}
+	if len(args) == 0 {
+		return result, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := db.Query(
+		`SELECT nk.note_id, k.name
+		 FROM note_keywords nk
+		 JOIN keywords k ON k.id = nk.keyword_id
+		 WHERE nk.note_id IN (`+placeholders+`)
+		 ORDER BY k.name`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var noteID string
+		var k Keyword
+		if err := rows.Scan(&noteID, &k.Name); err != nil {
+			return nil, err
+		}
+		result[noteID] = append(result[noteID], k)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeywordsForNotes(t *testing.T) {
+	setupTestDB(t)
+	a := createTestNote(t, "first", keywordLink{Name: "beta", Source: sourceManual}, keywordLink{Name: "alpha", Source: sourceManual})
+	b := createTestNote(t, "second", keywordLink{Name: "alpha", Source: sourceManual})
+	bare := createTestNote(t, "third")
+
+	t.Run("no ids", func(t *testing.T) {
+		for _, ids := range [][]string{nil, {}} {
+			got, err := keywordsForNotes(ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("keywordsForNotes(%v) = %v, want empty", ids, got)
+			}
+		}
+	})
+
+	t.Run("duplicate ids", func(t *testing.T) {
+		got, err := keywordsForNotes([]string{a, b, a, b, bare, "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]Keyword{
+			a: {{Name: "alpha"}, {Name: "beta"}},
+			b: {{Name: "alpha"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("keywordsForNotes = %v, want %v", got, want)
+		}
+	})
+}
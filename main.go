@@ -1,31 +1,192 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
+	initKeywordDelimiter()
+	initStopwords()
+	initBlocklist()
 	initTemplates()
+	initEncryption()
+	initSessions()
 	initDB()
+	initAI()
+	shutdownTracing := initTracing(context.Background())
 
-	// Define HTTP routes
-	http.HandleFunc("/", listNotesHandler)              // Handles listing notes and the creation form
-	http.HandleFunc("/notes/create", createNoteHandler) // Handles submission of the new note form
-	http.HandleFunc("/notes/edit/", editNoteHandler)    // Handles editing of an existing note
-	http.HandleFunc("/notes/", viewNoteHandler)         // Handles viewing a single note (e.g., /notes/12345)
-	http.HandleFunc("/keywords", listKeywordsHandler)   // List all available keywords and filter notes by keyword
-	http.HandleFunc("/keyword/", notesByKeywordHandler) // Handles viewing all notes for a given keyword (/keyword/{keyword})
+	// Define HTTP routes; methods are enforced and path parameters parsed by the router.
+	// Handlers making several writes run in a request-scoped transaction via withTx, and
+	// handlers changing data are wrapped in mutating so READ_ONLY can refuse them.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", listNotesHandler)                                                       // Handles listing notes and the creation form
+	mux.HandleFunc("POST /notes/create", mutating(withTx(createNoteHandler)))                          // Handles submission of the new note form
+	mux.HandleFunc("POST /capture", mutating(withTx(captureHandler)))                                  // Creates a note from a plain-text body (for bookmarklets and scripts)
+	mux.HandleFunc("POST /notes/bulk-delete", mutating(withTx(bulkDeleteHandler)))                     // Deletes the notes selected on the index page
+	mux.HandleFunc("POST /notes/merge", mutating(withTx(mergeNotesHandler)))                           // Merges a secondary note into a primary note
+	mux.HandleFunc("GET /notes/{id}", viewNoteHandler)                                                 // Handles viewing a single note (e.g., /notes/12345)
+	mux.HandleFunc("GET /n/{slug}", slugNoteHandler)                                                   // Views a note by its human-readable slug (e.g., /n/shopping-list)
+	mux.HandleFunc("GET /notes/{id}/raw", rawNoteHandler)                                              // Returns a note's content as plain text
+	mux.HandleFunc("GET /notes/{id}/terms", noteTermsHandler)                                          // A note's most frequent non-stopword terms as JSON
+	mux.HandleFunc("GET /notes/{id}/edit", mutating(editNoteHandler))                                  // Shows the edit form for an existing note
+	mux.HandleFunc("POST /notes/{id}/edit", mutating(withTx(updateNoteHandler)))                       // Handles submission of the edit form
+	mux.HandleFunc("POST /notes/{id}/autosave", mutating(autosaveNoteHandler))                         // Saves the edit form's content as a draft without touching the note
+	mux.HandleFunc("POST /notes/{id}/lock", mutating(toggleLockHandler))                               // Locks or unlocks a note against edits
+	mux.HandleFunc("POST /notes/{id}/star", mutating(toggleStarHandler))                               // Stars or unstars a note
+	mux.HandleFunc("POST /notes/{id}/toggle-task", mutating(withTx(toggleTaskHandler)))                // Ticks or unticks a checklist line of a note
+	mux.HandleFunc("POST /notes/{id}/touch", mutating(touchNoteHandler))                               // Brings a note to the top of the recently active list
+	mux.HandleFunc("POST /notes/{id}/retag", mutating(retagNoteHandler))                               // Regenerates a note's keywords with AI
+	mux.HandleFunc("POST /notes/{id}/share", mutating(shareNoteHandler))                               // Creates a public read-only link to a note
+	mux.HandleFunc("POST /notes/{id}/unshare", mutating(unshareNoteHandler))                           // Revokes a note's public link
+	mux.HandleFunc("POST /notes/{id}/suggest-title", suggestTitleHandler)                              // Returns an AI-suggested title as JSON
+	mux.HandleFunc("GET /shared/{token}", sharedNoteHandler)                                           // Read-only view of a shared note
+	mux.HandleFunc("GET /starred", starredHandler)                                                     // Lists starred notes
+	mux.HandleFunc("GET /today", todayHandler)                                                         // Notes tagged with today's date or created today
+	mux.HandleFunc("GET /week", weekHandler)                                                           // Notes created this week
+	mux.HandleFunc("GET /calendar", calendarHandler)                                                   // Month grid of notes by date keyword (?month=YYYY-MM)
+	mux.HandleFunc("GET /digest", digestHandler)                                                       // Plain-text digest of the notes created on a day (?date=YYYY-MM-DD)
+	mux.HandleFunc("GET /keywords", listKeywordsHandler)                                               // List all available keywords and filter notes by keyword
+	mux.HandleFunc("GET /keywords/orphans", orphanKeywordsHandler)                                     // Lists keywords not linked to any note as JSON
+	mux.HandleFunc("POST /keywords/{name}/rename", mutating(withTx(renameKeywordHandler)))             // Renames a keyword, merging it into an existing one of that name, as JSON
+	mux.HandleFunc("POST /keywords/merge-by-pattern", mutating(withTx(mergeKeywordsByPatternHandler))) // Merges all keywords matching a regex into one
+	mux.HandleFunc("POST /keywords/dedupe-ai", dedupeKeywordsHandler)                                  // Proposes merges of synonym keywords as JSON without applying them
+	mux.HandleFunc("POST /keywords/prune", mutating(pruneKeywordsHandler))                             // Deletes keywords not linked to any note
+	mux.HandleFunc("GET /keyword/{keyword}", notesByKeywordHandler)                                    // Handles viewing all notes for a given keyword
+	mux.HandleFunc("GET /keyword/{keyword}/related", relatedKeywordsHandler)                           // Lists keywords co-occurring with a keyword
+	mux.HandleFunc("GET /api/keywords", apiKeywordsHandler)                                            // Keywords with note counts as JSON (?minCount=N)
+	mux.HandleFunc("POST /api/suggest-keywords", suggestKeywordsHandler)                               // Keywords the posted content would get, as JSON, without saving
+	mux.HandleFunc("GET /stats", statsHandler)                                                         // AI keyword acceptance and keyword sources as JSON
+	mux.HandleFunc("GET /favicon.ico", faviconHandler)                                                 // Answers browser favicon requests with an empty response
+
+	// Backups write files on the server, so they are only offered where a directory
+	// has been set aside for them
+	if os.Getenv("BACKUP_DIR") != "" {
+		mux.HandleFunc("POST /admin/backup", mutating(backupHandler)) // Writes a consistent copy of the database to BACKUP_DIR
+	}
+
+	// Every request gets a deadline, which also cancels its OpenAI calls, and a 503
+	// once it passes. Streaming and profiling responses are long-lived by design and
+	// cannot be buffered, so they are routed around the timeout.
+	root := http.NewServeMux()
+	root.Handle("/", http.TimeoutHandler(withRouteSpanName(mux), envDuration("REQUEST_TIMEOUT", 30*time.Second), "Request timed out"))
+	root.HandleFunc("GET /notes/{id}/summary/stream", summaryStreamHandler) // Streams an AI summary of a note as server-sent events
+
+	// Profiling exposes internals, so it is only served when explicitly enabled
+	if envBool("ENABLE_PPROF") {
+		root.HandleFunc("GET /debug/pprof/", pprof.Index)
+		root.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+		root.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+		root.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+		root.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+		root.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+		log.Printf("Profiling endpoints enabled under /debug/pprof/")
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default port if not specified
 	}
 
-	log.Printf("Server starting on http://localhost:%s", port)
-	err := http.ListenAndServe(":"+port, nil)
+	// Stop background work and the server on Ctrl-C or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	aiJobs = newAIQueue(envInt("AI_WORKERS", 2), envInt("AI_QUEUE_SIZE", 100), envInt("AI_RATE_LIMIT", 60))
+	aiJobs.start(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runExpiryJanitor(ctx, envDuration("EXPIRY_JANITOR_INTERVAL", 10*time.Minute))
+	}()
+
+	handler := noStoreUnsafe(withSessions(withNoteActionPaths(withRouteSpanName(root))))
+	if envBool("DEV_MODE") {
+		handler = withTemplateDiagnostics(handler)
+	}
+	if host := os.Getenv("CANONICAL_HOST"); host != "" {
+		handler = withCanonicalHost(host, handler)
+	}
+	handler = withTracing(handler)
+	ln, err := listen(port)
 	if err != nil {
 		log.Fatalf("Could not start server: %s\n", err)
 	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
+
+	// With a certificate the server speaks HTTPS itself, for deployments without a
+	// reverse proxy in front
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if certFile != "" {
+		log.Printf("Server starting with TLS on https://localhost:%d", ln.Addr().(*net.TCPAddr).Port)
+		err = server.ServeTLS(ln, certFile, keyFile)
+	} else {
+		log.Printf("Server starting on http://localhost:%d", ln.Addr().(*net.TCPAddr).Port)
+		err = server.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Could not start server: %s\n", err)
+	}
+	stop()
+	wg.Wait()
+	aiJobs.wait()
+	// Flush the spans of the last requests before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
+	}
+	log.Printf("Server stopped")
+}
+
+// portFallbackAttempts is how many ports after PORT are tried with PORT_FALLBACK.
+const portFallbackAttempts = 10
+
+// listen opens the server's listener on port. With PORT_FALLBACK set, a port that is
+// already in use is skipped for the next free one of the few that follow, which is
+// handy when running several copies locally.
+func listen(port string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err == nil || !envBool("PORT_FALLBACK") || !errors.Is(err, syscall.EADDRINUSE) {
+		return ln, err
+	}
+	first, convErr := strconv.Atoi(port)
+	if convErr != nil {
+		return nil, err
+	}
+	for p := first + 1; p <= first+portFallbackAttempts; p++ {
+		ln, err = net.Listen("tcp", ":"+strconv.Itoa(p))
+		if err == nil {
+			log.Printf("Port %s is in use; using %d instead", port, p)
+			return ln, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("ports %s to %d are all in use", port, first+portFallbackAttempts)
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// setupTestDB points db at a fresh database in a temporary directory and loads the
+// repository's templates, for the duration of the test.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initTemplates()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Chdir(wd)
+	})
+	initDB()
+}
+
+// createTestNote saves a note with the given keyword links and returns its ID.
+func createTestNote(t *testing.T, content string, links ...keywordLink) string {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	id, err := insertNote(ctx, tx, content, nil, links)
+	if err != nil {
+		t.Fatalf("inserting note: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// txContextKey is the context key under which withTx stores the request's transaction.
+type txContextKey struct{}
+
+// requestTx is the transaction of a request handled by withTx. It is only begun when
+// the handler first asks for it, so slow work done before then, such as keyword
+// extraction, holds no database lock.
+type requestTx struct {
+	ctx  context.Context
+	tx   *sql.Tx
+	span trace.Span
+}
+
+// txFromContext returns the transaction of the current request, beginning it on the
+// first call. Transactions take the write lock when they begin (see initDB), so a
+// handler should call it only once it is ready to touch the database.
+func txFromContext(ctx context.Context) (*sql.Tx, error) {
+	rt, ok := ctx.Value(txContextKey{}).(*requestTx)
+	if !ok {
+		return nil, errors.New("no transaction outside withTx")
+	}
+	if rt.tx == nil {
+		ctx, span := tracer.Start(rt.ctx, "db.transaction")
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			endSpan(span, err)
+			return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		rt.tx, rt.span = tx, span
+	}
+	return rt.tx, nil
+}
+
+// commitHooksKey is the context key under which withTx keeps the functions to run
+// once the request's transaction has committed.
+type commitHooksKey struct{}
+
+// onCommit runs fn after the request's transaction commits, and not at all if it is
+// rolled back. Outside withTx, fn runs right away.
+func onCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(commitHooksKey{}).(*[]func())
+	if !ok {
+		fn()
+		return
+	}
+	*hooks = append(*hooks, fn)
+}
+
+// withTx runs a handler inside a database transaction available via txFromContext.
+// The transaction is committed when the handler responds with a status below 400 and
+// rolled back on an error status or a panic. The commit happens before the status is
+// sent, so a failed commit still turns into a 500 response.
+func withTx(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt := &requestTx{ctx: r.Context()}
+		tw := &txResponseWriter{ResponseWriter: w, rt: rt}
+		ctx := context.WithValue(r.Context(), commitHooksKey{}, &tw.afterCommit)
+		defer func() {
+			if p := recover(); p != nil {
+				if rt.tx != nil {
+					rt.tx.Rollback()
+					endSpan(rt.span, fmt.Errorf("panic: %v", p))
+				}
+				panic(p)
+			}
+			if !tw.wroteHeader {
+				tw.WriteHeader(http.StatusOK)
+			}
+		}()
+		h(tw, r.WithContext(context.WithValue(ctx, txContextKey{}, rt)))
+	}
+}
+
+// txResponseWriter finishes the transaction when the handler writes its status.
+type txResponseWriter struct {
+	http.ResponseWriter
+	rt          *requestTx
+	wroteHeader bool
+	failed      bool
+	// afterCommit holds the functions registered with onCommit.
+	afterCommit []func()
+}
+
+func (tw *txResponseWriter) WriteHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tx, span := tw.rt.tx, tw.rt.span
+	if status >= http.StatusBadRequest {
+		if tx != nil {
+			tx.Rollback()
+			span.SetAttributes(attribute.Bool("db.rolled_back", true))
+			span.End()
+		}
+		tw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	var err error
+	if tx != nil {
+		err = tx.Commit()
+		endSpan(span, err)
+	}
+	if err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		tw.failed = true
+		tw.Header().Del("Location")
+		http.Error(tw.ResponseWriter, "Error saving changes", http.StatusInternalServerError)
+		return
+	}
+	for _, fn := range tw.afterCommit {
+		fn()
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *txResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.failed {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// mutating guards a handler that changes notes or keywords, refusing the request
+// with 403 when READ_ONLY is set.
+func mutating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if envBool("READ_ONLY") {
+			http.Error(w, "This instance is read-only: notes can be browsed but not changed.", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// noStoreUnsafe marks the responses to requests other than GET and HEAD as not to be
+// stored by caches, since they reflect a change rather than a resource.
+func noStoreUnsafe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTemplateDiagnostics answers every request with the template parse error while
+// there is one. The templates are parsed again on each request until they succeed, so
+// fixing a template takes effect without a restart. It is only used in DEV_MODE.
+func withTemplateDiagnostics(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if templateErr != nil {
+			if t, err := parseTemplates(); err != nil {
+				templateErr = err
+			} else {
+				templates.Store(t)
+				templateErr = nil
+				log.Printf("Templates parsed successfully")
+			}
+		}
+		err := templateErr
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withNoteActionPaths accepts paths of the form /notes/{action}/{id}, where the
+// routes put the action after the note ID. The mux cannot hold both layouts, as a
+// path like /notes/edit/lock would match /notes/{id}/lock and /notes/edit/{id}
+// alike. Old edit links are redirected to /notes/{id}/edit; lock and star are served
+// as is.
+func withNoteActionPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, _ := strings.CutPrefix(r.URL.Path, "/notes/")
+		action, id, found := strings.Cut(rest, "/")
+		if _, err := strconv.ParseInt(id, 10, 64); !found || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := "/notes/" + id + "/" + action
+		switch action {
+		case "edit":
+			status := http.StatusPermanentRedirect
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				status = http.StatusMovedPermanently
+			}
+			if r.URL.RawQuery != "" {
+				path += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, path, status)
+		case "lock", "star":
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = path
+			r2.URL.RawPath = ""
+			next.ServeHTTP(w, r2)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// withCanonicalHost redirects requests for any other host name to host, keeping the
+// path and query, so links always point at one address. GET and HEAD requests get a
+// 301; other methods a 308, which makes clients repeat the request as it was.
+func withCanonicalHost(host string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Host, host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, scheme+"://"+host+r.URL.RequestURI(), status)
+	})
+}
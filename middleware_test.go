@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNoteActionPaths(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /notes/{id}/lock", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("lock " + r.PathValue("id")))
+	})
+	mux.HandleFunc("POST /notes/{id}/star", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("star " + r.PathValue("id")))
+	})
+	handler := withNoteActionPaths(mux)
+
+	tests := []struct {
+		method, path string
+		status       int
+		location     string
+		body         string
+	}{
+		{http.MethodGet, "/notes/edit/12?draft=1", http.StatusMovedPermanently, "/notes/12/edit?draft=1", ""},
+		{http.MethodPost, "/notes/edit/12", http.StatusPermanentRedirect, "/notes/12/edit", ""},
+		{http.MethodPost, "/notes/lock/12", http.StatusOK, "", "lock 12"},
+		{http.MethodPost, "/notes/12/lock", http.StatusOK, "", "lock 12"},
+		{http.MethodPost, "/notes/star/12", http.StatusOK, "", "star 12"},
+		{http.MethodPost, "/notes/lock/abc", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s %s: Location = %q, want %q", tt.method, tt.path, got, tt.location)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: body = %q, want %q", tt.method, tt.path, w.Body.String(), tt.body)
+		}
+	}
+}
@@ -7,11 +7,30 @@ type Note struct {
 	ID        string    `json:"id"`
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is set for ephemeral notes, which are deleted once it has passed.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Locked notes cannot be edited until they are unlocked.
+	Locked bool `json:"locked"`
+	// Starred marks a favorite note; it does not affect ordering.
+	Starred bool `json:"starred"`
+	// ShareToken grants read-only access via /shared/{token}; empty when not shared.
+	ShareToken string `json:"-"`
+	// Slug is the human-readable permalink name used by /n/{slug}, if the note has one.
+	Slug string `json:"slug,omitempty"`
 }
 
 // Keyword defines a tag or label for a note.
 type Keyword struct {
 	Name string `json:"name"`
+	// Source tells how the keyword was linked to a note (see sourceManual and
+	// friends); only set where a single note's keywords are listed.
+	Source string `json:"source,omitempty"`
+}
+
+// KeywordUsage pairs a keyword with the number of notes it occurs on.
+type KeywordUsage struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
 }
 
 // NoteWithKeywords combines a Note with its associated Keywords.
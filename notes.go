@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// errNoteLimit is returned when creating a note would exceed MAX_NOTES.
+var errNoteLimit = errors.New("the maximum number of notes has been reached")
+
+// insertNote stores a new note together with its keyword links within tx and
+// returns the ID of the note. It fails with errNoteLimit once MAX_NOTES notes exist.
+// The note's slug is derived from its content on creation and kept on later edits.
+func insertNote(ctx context.Context, tx *sql.Tx, content string, expiresAt *time.Time, keywords []keywordLink) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "db.insertNote")
+	defer func() { endSpan(span, err) }()
+	if max := envInt("MAX_NOTES", 0); max > 0 {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM notes").Scan(&count); err != nil {
+			return "", fmt.Errorf("failed to count notes: %v", err)
+		}
+		if count >= max {
+			return "", errNoteLimit
+		}
+	}
+	stored, err := encodeContent(content)
+	if err != nil {
+		return "", err
+	}
+	// The slug would reveal the first line of the note, so encrypted notes get none
+	var slug sql.NullString
+	if contentCipher == nil {
+		if slug.String, err = uniqueSlug(tx, slugify(content)); err != nil {
+			return "", err
+		}
+		slug.Valid = true
+	}
+	newID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := tx.Exec(
+		"INSERT INTO notes(id, content, created_at, expires_at, slug) VALUES(?, ?, ?, ?, ?)",
+		newID, stored, time.Now(), expiresAt, slug,
+	); err != nil {
+		return "", err
+	}
+	if err := linkKeywords(ctx, tx, newID, keywords); err != nil {
+		return "", err
+	}
+	return newID, nil
+}
+
+// extractAndLinkKeywords runs AI keyword extraction for a note that has already
+// been saved and links the result to it, or the fallback keywords if the AI call
+// fails. It is run as a background AI job.
+func extractAndLinkKeywords(ctx context.Context, noteID, content string) error {
+	existing, err := keywordCandidates(content)
+	if err != nil {
+		log.Printf("Error querying existing keywords: %v", err)
+	}
+	var links []keywordLink
+	if autoKeys, err := extractKeywords(withAuditNoteID(ctx, noteID), content, existing); err != nil {
+		logAIError("Error extracting keywords, using word frequencies instead", err)
+		links = linksFrom(sourceFallback, fallbackKeywords(content))
+	} else {
+		links = linksFrom(sourceAI, autoKeys)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := linkKeywords(ctx, tx, noteID, links); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retagNote replaces the AI and date keywords of a note with freshly extracted ones;
+// manual keywords are kept and merged with the new set. The extraction runs before
+// the transaction so no lock is held while waiting for the model, and the existing
+// keywords are kept if it fails.
+func retagNote(ctx context.Context, noteID, content string) error {
+	existing, err := keywordCandidates(content)
+	if err != nil {
+		log.Printf("Error querying existing keywords: %v", err)
+	}
+	autoKeys, err := extractKeywords(withAuditNoteID(ctx, noteID), content, existing)
+	if err != nil {
+		return fmt.Errorf("failed to extract keywords: %w", err)
+	}
+	keywords := slices.Concat(linksFrom(sourceDate, extractDateKeywords(content)), linksFrom(sourceAI, autoKeys))
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := clearExtractedKeywords(tx, noteID); err != nil {
+		return fmt.Errorf("failed to clear keywords of note %s: %v", noteID, err)
+	}
+	if err := linkKeywords(ctx, tx, noteID, keywords); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// defaultNoteSort is the order of note lists when ?sort= is not given.
+const defaultNoteSort = "newest"
+
+// noteSortOrders maps the ?sort= options of note lists to ORDER BY clauses on the
+// notes (aliased n). Every user-chosen note order goes through this safelist, since
+// the clause is put into the query as is.
+var noteSortOrders = map[string]string{
+	"newest": "n.created_at DESC",
+	"oldest": "n.created_at ASC",
+	// Touched notes count as new from when they were touched
+	"active": "COALESCE(n.bumped_at, n.created_at) DESC",
+}
+
+// noteOrder returns the option and ORDER BY clause for a ?sort= value, falling back to
+// defaultNoteSort when it is empty. ok is false for unknown options.
+func noteOrder(sortBy string) (name, order string, ok bool) {
+	if sortBy == "" {
+		sortBy = defaultNoteSort
+	}
+	order, ok = noteSortOrders[sortBy]
+	return sortBy, order, ok
+}
+
+// noteSortNames lists the ?sort= options of note lists, for error messages.
+func noteSortNames() string {
+	names := make([]string, 0, len(noteSortOrders))
+	for name := range noteSortOrders {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// loadNoteWithKeywords returns a note and its keywords, with their sources, as seen
+// by tx.
+func loadNoteWithKeywords(tx *sql.Tx, noteID string) (NoteWithKeywords, error) {
+	var n NoteWithKeywords
+	var expiresAt sql.NullTime
+	err := tx.QueryRow(
+		"SELECT id, content, created_at, expires_at, locked, starred FROM notes WHERE id = ?", noteID,
+	).Scan(&n.Note.ID, decoded(&n.Note.Content), &n.Note.CreatedAt, &expiresAt, &n.Note.Locked, &n.Note.Starred)
+	if err != nil {
+		return n, err
+	}
+	if expiresAt.Valid {
+		n.Note.ExpiresAt = &expiresAt.Time
+	}
+	rows, err := tx.Query(
+		"SELECT k.name, nk.source FROM note_keywords nk JOIN keywords k ON k.id = nk.keyword_id WHERE nk.note_id = ? ORDER BY k.name",
+		noteID,
+	)
+	if err != nil {
+		return n, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k Keyword
+		if err := rows.Scan(&k.Name, &k.Source); err != nil {
+			return n, err
+		}
+		n.Keywords = append(n.Keywords, k)
+	}
+	return n, rows.Err()
+}
+
+// notesCreatedBetween returns the unexpired notes created in [from, to), oldest first,
+// together with their keywords.
+func notesCreatedBetween(from, to time.Time) ([]NoteWithKeywords, error) {
+	rows, err := db.Query(
+		`SELECT n.id, n.content, n.created_at, k.name
+		 FROM notes n
+		 LEFT JOIN note_keywords nk ON n.id = nk.note_id
+		 LEFT JOIN keywords k ON nk.keyword_id = k.id
+		 WHERE n.created_at >= ? AND n.created_at < ?
+		   AND (n.expires_at IS NULL OR n.expires_at > ?)
+		 ORDER BY n.created_at, k.name`,
+		from, to, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	noteMap := make(map[string]*NoteWithKeywords)
+	order := []string{}
+	for rows.Next() {
+		var note Note
+		var kwName sql.NullString
+		if err := rows.Scan(&note.ID, decoded(&note.Content), &note.CreatedAt, &kwName); err != nil {
+			return nil, err
+		}
+		if _, exists := noteMap[note.ID]; !exists {
+			noteMap[note.ID] = &NoteWithKeywords{Note: note}
+			order = append(order, note.ID)
+		}
+		if kwName.Valid {
+			noteMap[note.ID].Keywords = append(noteMap[note.ID].Keywords, Keyword{Name: kwName.String})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	notes := make([]NoteWithKeywords, 0, len(order))
+	for _, id := range order {
+		notes = append(notes, *noteMap[id])
+	}
+	return notes, nil
+}
+
+// notesByDateKeyword returns the unexpired notes tagged with a day of month
+// (YYYY-MM), keyed by the ISO date keyword, oldest first within each day.
+func notesByDateKeyword(month string) (map[string][]Note, error) {
+	rows, err := db.Query(
+		`SELECT k.name, n.id, n.content, n.created_at
+		 FROM keywords k
+		 JOIN note_keywords nk ON nk.keyword_id = k.id
+		 JOIN notes n ON n.id = nk.note_id
+		 WHERE k.name GLOB ? AND (n.expires_at IS NULL OR n.expires_at > ?)
+		 ORDER BY k.name, n.created_at`,
+		month+"-[0-3][0-9]", time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make(map[string][]Note)
+	for rows.Next() {
+		var date string
+		var note Note
+		if err := rows.Scan(&date, &note.ID, decoded(&note.Content), &note.CreatedAt); err != nil {
+			return nil, err
+		}
+		notes[date] = append(notes[date], note)
+	}
+	return notes, rows.Err()
+}
+
+// maxSlugLength limits how many characters of the first line end up in a slug.
+const maxSlugLength = 60
+
+// slugify turns the first line of content into a lowercase slug where each run of
+// characters other than letters and digits becomes a single dash.
+func slugify(content string) string {
+	firstLine, _, _ := strings.Cut(content, "\n")
+	var b strings.Builder
+	dash := false
+	n := 0
+	for _, r := range strings.ToLower(firstLine) {
+		if n >= maxSlugLength {
+			break
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+				n++
+			}
+			b.WriteRune(r)
+			n++
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "note"
+	}
+	return b.String()
+}
+
+// uniqueSlug returns base, or base with the lowest numeric suffix from 2 up that no
+// other note uses.
+func uniqueSlug(tx *sql.Tx, base string) (string, error) {
+	slug := base
+	for i := 2; ; i++ {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM notes WHERE slug = ?)", slug).Scan(&exists); err != nil {
+			return "", fmt.Errorf("failed to check slug %q: %v", slug, err)
+		}
+		if !exists {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// stubOpenAI answers chat completions with reply as the message content and enables
+// AI for the duration of the test. It returns the number of calls made so far.
+func stubOpenAI(t *testing.T, reply string) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"choices": []map[string]any{{"message": map[string]string{"role": "assistant", "content": reply}}},
+		})
+	}))
+	previous := openAIChatURL
+	openAIChatURL = srv.URL
+	t.Cleanup(func() {
+		srv.Close()
+		openAIChatURL = previous
+		aiEnabled = false
+	})
+	t.Setenv("OPENAI_API_KEY", "test")
+	initAI()
+	return &calls
+}
+
+// noteKeywordSources returns the keywords of a note mapped to their sources.
+func noteKeywordSources(t *testing.T, noteID string) map[string]string {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	sources, err := keywordSources(tx, noteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sources
+}
+
+func TestRetagNoteKeepsManualKeywords(t *testing.T) {
+	setupTestDB(t)
+	stubOpenAI(t, `{"keywords": ["fresh", "kept"]}`)
+	content := "Plan for 2025-06-15"
+	id := createTestNote(t, content,
+		keywordLink{Name: "kept", Source: sourceManual},
+		keywordLink{Name: "mine", Source: sourceManual},
+		keywordLink{Name: "stale", Source: sourceAI},
+		keywordLink{Name: "2020-01-01", Source: sourceDate},
+	)
+
+	if err := retagNote(context.Background(), id, content); err != nil {
+		t.Fatalf("retagNote: %v", err)
+	}
+
+	want := map[string]string{
+		"kept":       sourceManual,
+		"mine":       sourceManual,
+		"fresh":      sourceAI,
+		"2025-06-15": sourceDate,
+	}
+	if got := noteKeywordSources(t, id); !reflect.DeepEqual(got, want) {
+		t.Errorf("keywords after retag = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionCookieName is the cookie carrying the signed session ID.
+const sessionCookieName = "notes_session"
+
+// sessionKey signs session cookies, so a client cannot pick another client's ID.
+var sessionKey []byte
+
+// initSessions sets the session signing key from SESSION_SECRET. Without it a random
+// key is used, which ends all sessions when the server restarts.
+func initSessions() {
+	if v := os.Getenv("SESSION_SECRET"); v != "" {
+		sessionKey = []byte(v)
+		return
+	}
+	sessionKey = make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		log.Fatalf("Could not generate session key: %v", err)
+	}
+	log.Printf("SESSION_SECRET is not set; sessions will not survive a restart")
+}
+
+// sessionTouchInterval is how often the last request of a session is recorded. Doing
+// it on every request would turn each page view into a database write.
+const sessionTouchInterval = time.Minute
+
+// sessionIdleTimeout is how long a session survives without requests.
+func sessionIdleTimeout() time.Duration {
+	return envDuration("SESSION_IDLE_TIMEOUT", 24*time.Hour)
+}
+
+// session holds the server-side values of one client. A session without an ID has
+// not been stored yet; it gets one, and the client a cookie, when a value is set.
+type session struct {
+	mu     sync.Mutex
+	id     string
+	values map[string]string
+}
+
+// sessionContextKey is the context key under which withSessions stores the session.
+type sessionContextKey struct{}
+
+// withSessions loads the session named by the request's cookie, if it is validly
+// signed and has not been idle for too long, and makes it available to handlers.
+// Requests without one get an empty session, so clients that never store anything
+// never get a cookie.
+func withSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &session{values: make(map[string]string)}
+		if c, err := r.Cookie(sessionCookieName); err == nil {
+			if id, ok := verifySessionCookie(c.Value); ok {
+				if err := loadSession(s, id); err != nil {
+					log.Printf("Error loading session: %v", err)
+				}
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, s)))
+	})
+}
+
+// sessionFromRequest returns the request's session, or an empty one outside withSessions.
+func sessionFromRequest(r *http.Request) *session {
+	if s, ok := r.Context().Value(sessionContextKey{}).(*session); ok {
+		return s
+	}
+	return &session{values: make(map[string]string)}
+}
+
+// signSessionID returns the cookie value for a session ID.
+func signSessionID(id string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionCookie returns the session ID from a cookie value if its signature is valid.
+func verifySessionCookie(value string) (string, bool) {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(value), []byte(signSessionID(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// loadSession fills s from the stored session id unless it has expired, and marks
+// it as seen if that was not done within sessionTouchInterval. An unknown or expired
+// ID leaves s empty.
+func loadSession(s *session, id string) error {
+	var data string
+	var lastSeen time.Time
+	err := db.QueryRow(
+		"SELECT data, last_seen FROM sessions WHERE id = ? AND last_seen > ?",
+		id, time.Now().Add(-sessionIdleTimeout()),
+	).Scan(&data, &lastSeen)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(data), &s.values); err != nil {
+		return fmt.Errorf("malformed session %s: %v", id, err)
+	}
+	s.id = id
+	if time.Since(lastSeen) < sessionTouchInterval {
+		return nil
+	}
+	_, err = db.Exec("UPDATE sessions SET last_seen = ? WHERE id = ?", time.Now(), id)
+	return err
+}
+
+// sessionValue returns the value stored under key in the request's session.
+func sessionValue(r *http.Request, key string) string {
+	s := sessionFromRequest(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// setSessionValue stores value under key in the request's session; an empty value
+// removes the key. The first value stored starts the session and sets its cookie, so
+// it must be called before the response status is written.
+func setSessionValue(w http.ResponseWriter, r *http.Request, key, value string) error {
+	s := sessionFromRequest(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == "" {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	if s.id == "" {
+		if value == "" {
+			return nil
+		}
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return fmt.Errorf("failed to generate session ID: %v", err)
+		}
+		s.id = hex.EncodeToString(buf)
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    signSessionID(s.id),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	data, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"INSERT OR REPLACE INTO sessions(id, data, last_seen) VALUES(?, ?, ?)",
+		s.id, string(data), time.Now(),
+	)
+	return err
+}
+
+// flashSessionKey is the session key of the message shown on the client's next page.
+const flashSessionKey = "flash"
+
+// setFlash stores a message to show on the next page the client views, usually the
+// one it is redirected to. A failure is logged and the message is not shown.
+func setFlash(w http.ResponseWriter, r *http.Request, msg string) {
+	if err := setSessionValue(w, r, flashSessionKey, msg); err != nil {
+		log.Printf("Error storing flash message: %v", err)
+	}
+}
+
+// takeFlash returns the message stored by setFlash and removes it, so it is shown once.
+func takeFlash(w http.ResponseWriter, r *http.Request) string {
+	msg := sessionValue(r, flashSessionKey)
+	if msg != "" {
+		setFlash(w, r, "")
+	}
+	return msg
+}
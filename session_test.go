@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSessionThrottlesLastSeen(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO sessions(id, data, last_seen) VALUES('s', '{\"k\":\"v\"}', ?)", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	lastSeenAfterLoad := func(ago time.Duration) time.Time {
+		t.Helper()
+		before := time.Now().Add(-ago)
+		if _, err := db.Exec("UPDATE sessions SET last_seen = ? WHERE id = 's'", before); err != nil {
+			t.Fatal(err)
+		}
+		s := &session{values: make(map[string]string)}
+		if err := loadSession(s, "s"); err != nil {
+			t.Fatal(err)
+		}
+		if s.values["k"] != "v" {
+			t.Fatalf("session values = %v, want k=v", s.values)
+		}
+		var lastSeen time.Time
+		if err := db.QueryRow("SELECT last_seen FROM sessions WHERE id = 's'").Scan(&lastSeen); err != nil {
+			t.Fatal(err)
+		}
+		return lastSeen
+	}
+
+	if got := lastSeenAfterLoad(10 * time.Second); time.Since(got) < 5*time.Second {
+		t.Errorf("last_seen was updated by a request %v after the previous one", 10*time.Second)
+	}
+	if got := lastSeenAfterLoad(2 * time.Minute); time.Since(got) > 5*time.Second {
+		t.Errorf("last_seen is %v old after a request, want it updated", time.Since(got))
+	}
+}
+
+func TestFlashShownOnce(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("SESSION_SECRET", "test")
+	initSessions()
+	noteID := createTestNote(t, "Buy milk")
+
+	r := httptest.NewRequest(http.MethodPost, "/notes/"+noteID+"/touch", nil)
+	r.SetPathValue("id", noteID)
+	w := httptest.NewRecorder()
+	withSessions(http.HandlerFunc(touchNoteHandler)).ServeHTTP(w, r)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+		t.Fatalf("cookies = %v, want a session cookie", cookies)
+	}
+
+	for i, want := range []bool{true, false} {
+		r := httptest.NewRequest(http.MethodGet, "/notes/"+noteID, nil)
+		r.SetPathValue("id", noteID)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		withSessions(http.HandlerFunc(viewNoteHandler)).ServeHTTP(w, r)
+		if got := strings.Contains(w.Body.String(), noteFlashes["touched"]); got != want {
+			t.Errorf("view %d: flash shown = %v, want %v", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// builtinStopwords are common words per language that say nothing about what a note
+// is about, selectable with STOPWORD_LANGUAGES.
+var builtinStopwords = map[string][]string{
+	"en": strings.Fields(`a about after all also an and any are as at be because been but by
+		can could did do does for from had has have he her his how i if in into is it its
+		just like me more my no not of on one only or other our out over she so some than
+		that the their them then there these they this to too up us was we were what when
+		where which who will with would you your`),
+	"no": strings.Fields(`alle at av bare da de deg dei dem den denne der dere det dette du
+		eller en er et etter for fra før ha hadde han har hen her hun hva hvis hvor i ikke
+		inn jeg kan kom kun man med meg men mer min mitt må ned noe noen når og også om opp
+		på seg selv sin sitt skal som så til ut var ved vi vil være vår å`),
+}
+
+// stopwords is the set of lowercased words that are never used as keywords.
+var stopwords map[string]bool
+
+// initStopwords loads the stopwords from STOPWORDS_FILE, a file with one word per
+// line where lines starting with # are comments. Without it the built-in lists named
+// in STOPWORD_LANGUAGES, a comma-separated list defaulting to "en,no", are used.
+func initStopwords() {
+	stopwords = make(map[string]bool)
+	if path := os.Getenv("STOPWORDS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Could not open STOPWORDS_FILE: %v", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if w := strings.ToLower(strings.TrimSpace(scanner.Text())); w != "" && !strings.HasPrefix(w, "#") {
+				stopwords[w] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("Could not read STOPWORDS_FILE: %v", err)
+		}
+		return
+	}
+	languages := os.Getenv("STOPWORD_LANGUAGES")
+	if languages == "" {
+		languages = "en,no"
+	}
+	for _, lang := range strings.Split(languages, ",") {
+		lang = strings.TrimSpace(lang)
+		words, ok := builtinStopwords[lang]
+		if !ok {
+			log.Printf("Unknown stopword language %q in STOPWORD_LANGUAGES", lang)
+			continue
+		}
+		for _, w := range words {
+			stopwords[w] = true
+		}
+	}
+}
+
+// keywordDropReason returns why name is not worth storing as a keyword, or "" if it
+// is: keywords must not be stopwords and must be at least KEYWORD_MIN_LENGTH
+// (default 2) runes long.
+func keywordDropReason(name string) string {
+	if stopwords[strings.ToLower(name)] {
+		return "it is a stopword"
+	}
+	if minLen := envInt("KEYWORD_MIN_LENGTH", 2); utf8.RuneCountInString(name) < minLen {
+		return fmt.Sprintf("it is shorter than %d characters", minLen)
+	}
+	return ""
+}
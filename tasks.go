@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// taskLinePattern matches checklist lines such as "- [ ] buy milk" and "- [x] done",
+// capturing the part before the box, the box state and the task text.
+var taskLinePattern = regexp.MustCompile(`^(\s*- \[)([ xX])\](.*)$`)
+
+// renderContent renders note content like linkify, except that checklist lines
+// become checkboxes. When interactive, each checkbox toggles its task through
+// POST /notes/{id}/toggle-task; the form sends the line's number and text so the
+// handler can find the line again if the content has changed since.
+func renderContent(content, noteID string, interactive bool) template.HTML {
+	var b strings.Builder
+	var text []string
+	flush := func() {
+		if len(text) > 0 {
+			b.WriteString(string(linkify(strings.Join(text, "\n"))))
+			text = nil
+		}
+	}
+	for i, line := range strings.Split(content, "\n") {
+		m := taskLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			text = append(text, line)
+			continue
+		}
+		flush()
+		checked := ""
+		if m[2] != " " {
+			checked = " checked"
+		}
+		label := linkify(strings.TrimSpace(m[3]))
+		if !interactive {
+			fmt.Fprintf(&b, `<span class="task"><input type="checkbox" disabled%s> %s</span>`, checked, label)
+			continue
+		}
+		fmt.Fprintf(&b,
+			`<form class="task" action="/notes/%s/toggle-task" method="POST">`+
+				`<input type="hidden" name="line" value="%d"><input type="hidden" name="text" value="%s">`+
+				`<input type="checkbox" onchange="this.form.submit()"%s> %s</form>`,
+			template.HTMLEscapeString(noteID), i, template.HTMLEscapeString(line), checked, label,
+		)
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+// toggleTask flips the checkbox of the task line at index, or of the first line with
+// the same text if the line has moved, and returns the new content. ok is false when
+// no line matches text any more.
+func toggleTask(content string, index int, text string) (_ string, ok bool) {
+	lines := strings.Split(content, "\n")
+	if index < 0 || index >= len(lines) || lines[index] != text {
+		index = -1
+		for i, line := range lines {
+			if line == text {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		return content, false
+	}
+	m := taskLinePattern.FindStringSubmatch(lines[index])
+	if m == nil {
+		return content, false
+	}
+	state := "x"
+	if m[2] != " " {
+		state = " "
+	}
+	lines[index] = m[1] + state + "]" + m[3]
+	return strings.Join(lines, "\n"), true
+}
+
+// toggleTaskHandler ticks or unticks a checklist item of a note and redirects back
+// to it. It answers 409 Conflict if the line was changed or removed since the page
+// was rendered.
+func toggleTaskHandler(w http.ResponseWriter, r *http.Request) {
+	noteID := r.PathValue("id")
+	index, err := strconv.Atoi(r.FormValue("line"))
+	if err != nil {
+		http.Error(w, "line must be a number", http.StatusBadRequest)
+		return
+	}
+	tx, err := txFromContext(r.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	var content string
+	var locked bool
+	err = tx.QueryRow("SELECT content, locked FROM notes WHERE id = ?", noteID).Scan(decoded(&content), &locked)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error querying note %s for task toggle: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "This note is locked and cannot be edited", http.StatusForbidden)
+		return
+	}
+
+	content, ok := toggleTask(content, index, r.FormValue("text"))
+	if !ok {
+		http.Error(w, "The task has changed since the note was loaded; reload the note and try again", http.StatusConflict)
+		return
+	}
+	stored, err := encodeContent(content)
+	if err != nil {
+		log.Printf("Error encoding note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE notes SET content = ? WHERE id = ?", stored, noteID); err != nil {
+		log.Printf("Error updating note %s: %v", noteID, err)
+		http.Error(w, "Error updating note", http.StatusInternalServerError)
+		return
+	}
+	fireNoteWebhook(r.Context(), tx, eventNoteUpdated, noteID)
+	http.Redirect(w, r, fmt.Sprintf("/notes/%s", noteID), http.StatusFound)
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"html/template"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"unicode/utf8"
 )
 
-var templates *template.Template
+// templates holds the parsed templates. It is swapped atomically because
+// withTemplateDiagnostics replaces it while other requests are rendering.
+var templates atomic.Pointer[template.Template]
 
-// initTemplates initializes HTML templates with custom functions.
+// templateDir is the directory the templates are loaded from, found by initTemplates.
+var templateDir = "templates"
+
+// templateErr is the error from parsing the templates, kept in DEV_MODE instead of
+// exiting so withTemplateDiagnostics can report it.
+var templateErr error
+
+// initTemplates locates and parses the HTML templates. A template that fails to parse
+// is fatal, except in DEV_MODE, where the error is served instead until it is fixed.
 func initTemplates() {
-	templateDir := "templates"
 	// Check if running from project root or if templates dir is directly accessible
 	if _, err := os.Stat(templateDir); os.IsNotExist(err) {
 		// If not found, try to locate it relative to the executable's path
@@ -36,23 +53,99 @@ func initTemplates() {
 	}
 
 	log.Printf("Loading templates from: %s", templateDir)
+	t, err := parseTemplates()
+	if err != nil {
+		if !envBool("DEV_MODE") {
+			log.Fatalf("Could not parse templates: %v", err)
+		}
+		log.Printf("Could not parse templates: %v", err)
+		templates.Store(template.New(""))
+		templateErr = err
+		return
+	}
+	templates.Store(t)
+}
+
+// parseTemplates parses the templates in templateDir with the custom functions.
+func parseTemplates() (*template.Template, error) {
+	previewLength := envInt("PREVIEW_LENGTH", 100)
 	funcMap := template.FuncMap{
 		"shorten": func(s string) string {
-			if len(s) > 100 {
-				return s[:100] + "..."
+			if runes := []rune(s); len(runes) > previewLength {
+				return string(runes[:previewLength]) + "..."
 			}
 			return s
 		},
+		"isShortened": func(s string) bool {
+			return utf8.RuneCountInString(s) > previewLength
+		},
 		"joinKeywords": func(keys []Keyword) string {
 			var names []string
 			for _, k := range keys {
 				names = append(names, k.Name)
 			}
-			return strings.Join(names, ", ")
+			return formatKeywordInput(names)
+		},
+		"linkify":       linkify,
+		"renderContent": renderContent,
+		"keywordDelimiter": func() string {
+			return keywordDelimiterName
+		},
+		"readOnly": func() bool {
+			return envBool("READ_ONLY")
 		},
+		"keywordSourceTitle": keywordSourceTitle,
+	}
+	return template.New("").Funcs(funcMap).ParseGlob(filepath.Join(templateDir, "*.html"))
+}
+
+// urlPattern matches http and https URLs in plain text.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// linkify HTML-escapes text and turns the http and https URLs in it into links.
+// Everything is escaped before it is emitted, so the result is safe to render.
+func linkify(text string) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, m := range urlPattern.FindAllStringIndex(text, -1) {
+		start, end := m[0], m[1]
+		// Leave trailing punctuation such as a sentence's full stop outside the link
+		end = start + len(strings.TrimRight(text[start:end], ".,;:!?)]"))
+		if strings.HasSuffix(text[start:end], "://") {
+			continue
+		}
+		url := template.HTMLEscapeString(text[start:end])
+		b.WriteString(template.HTMLEscapeString(text[last:start]))
+		b.WriteString(`<a href="` + url + `" rel="nofollow noopener">` + url + `</a>`)
+		last = end
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// renderPage executes the named template into a buffer so that status, ETag and
+// Content-Length can be set before anything is sent. The body is omitted for HEAD
+// requests, and a matching If-None-Match on a 200 response yields 304 Not Modified.
+func renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := templates.Load().ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("Error executing %s template: %v", name, err)
+		http.Error(w, "Error rendering page", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(buf.Bytes())
 	}
-	templates = template.Must(
-		template.New("").Funcs(funcMap).
-			ParseGlob(filepath.Join(templateDir, "*.html")),
-	)
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the application's spans. Until initTracing installs an exporting
+// provider it is a no-op, so spans cost next to nothing when tracing is off.
+var tracer = otel.Tracer("github.com/asmundstavdahl/notes-go-1")
+
+// initTracing exports traces over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set;
+// the exporter reads the endpoint and the other standard OTEL_* variables itself. It
+// returns a function that flushes pending spans on shutdown.
+func initTracing(ctx context.Context) func(context.Context) error {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatalf("Could not create trace exporter: %v", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("notes-go-1")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		log.Fatalf("Could not create trace resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Printf("Tracing enabled, exporting to %s", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	return provider.Shutdown
+}
+
+// withTracing starts a span for each request, continuing a trace propagated by the
+// caller. Handlers pass the request context on, so their spans nest under it. The
+// span is named by the method alone until withRouteSpanName names it by its route.
+func withTracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// withRouteSpanName names the request's span by the mux pattern the request matches,
+// such as "GET /shared/{token}". Naming it by the path would create a span name per
+// note and put share tokens into the traces. Requests matching no pattern keep the
+// method as their name.
+func withRouteSpanName(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		name := r.Method
+		if _, pattern := mux.Handler(r); pattern != "" {
+			// Patterns registered without a method match any method
+			method, route, found := strings.Cut(pattern, " ")
+			if !found {
+				method, route = r.Method, pattern
+			}
+			name = method + " " + route
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetName(name)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// webhookAttempts is how many times a webhook delivery is tried before giving up.
+const webhookAttempts = 3
+
+// Webhook events, sent in the X-Notes-Event header.
+const (
+	eventNoteCreated = "note.created"
+	eventNoteUpdated = "note.updated"
+	eventNoteDeleted = "note.deleted"
+)
+
+// webhookEnabled reports whether event is to be sent: WEBHOOK_URL must be set, and
+// the event listed in the comma-separated WEBHOOK_EVENTS, which defaults to all.
+func webhookEnabled(event string) bool {
+	if os.Getenv("WEBHOOK_URL") == "" {
+		return false
+	}
+	v := os.Getenv("WEBHOOK_EVENTS")
+	if v == "" {
+		return true
+	}
+	for _, e := range splitKeywords(v, ",") {
+		switch e = strings.ToLower(e); e {
+		case event:
+			return true
+		case eventNoteCreated, eventNoteUpdated, eventNoteDeleted:
+		default:
+			log.Printf("Ignoring unknown webhook event %q in WEBHOOK_EVENTS", e)
+		}
+	}
+	return false
+}
+
+// fireWebhook sends payload as JSON to WEBHOOK_URL as event, in the background once
+// the request's transaction has committed. Disabled events are skipped, and failures
+// are only logged, since the change itself has been saved.
+func fireWebhook(ctx context.Context, event string, payload any) {
+	if !webhookEnabled(event) {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s webhook: %v", event, err)
+		return
+	}
+	url := os.Getenv("WEBHOOK_URL")
+	ctx = context.WithoutCancel(ctx)
+	onCommit(ctx, func() {
+		go deliverWebhook(ctx, url, event, body)
+	})
+}
+
+// webhookNote is the payload of note.created and note.updated events.
+type webhookNote struct {
+	ID        string     `json:"id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Locked    bool       `json:"locked"`
+	Starred   bool       `json:"starred"`
+	Keywords  []Keyword  `json:"keywords"`
+}
+
+// fireNoteWebhook sends event with the note and its keywords as the payload.
+func fireNoteWebhook(ctx context.Context, tx *sql.Tx, event, noteID string) {
+	if !webhookEnabled(event) {
+		return
+	}
+	note, err := loadNoteWithKeywords(tx, noteID)
+	if err != nil {
+		log.Printf("Error loading note %s for %s webhook: %v", noteID, event, err)
+		return
+	}
+	keywords := note.Keywords
+	if keywords == nil {
+		keywords = []Keyword{}
+	}
+	fireWebhook(ctx, event, webhookNote{
+		ID:        note.Note.ID,
+		Content:   note.Note.Content,
+		CreatedAt: note.Note.CreatedAt,
+		ExpiresAt: note.Note.ExpiresAt,
+		Locked:    note.Note.Locked,
+		Starred:   note.Note.Starred,
+		Keywords:  keywords,
+	})
+}
+
+// fireNoteDeletedWebhook sends a note.deleted event with the ID of the deleted note.
+func fireNoteDeletedWebhook(ctx context.Context, noteID string) {
+	fireWebhook(ctx, eventNoteDeleted, struct {
+		ID string `json:"id"`
+	}{noteID})
+}
+
+// deliverWebhook POSTs body to url with the event in the X-Notes-Event header. Each
+// attempt times out after WEBHOOK_TIMEOUT; failed attempts are retried with a growing
+// pause, up to webhookAttempts in all.
+func deliverWebhook(ctx context.Context, url, event string, body []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		if err = postWebhook(ctx, url, event, body); err == nil {
+			return
+		}
+		log.Printf("Webhook %s attempt %d/%d failed: %v", event, attempt, webhookAttempts, err)
+	}
+	log.Printf("Giving up on webhook %s: %v", event, err)
+}
+
+// postWebhook makes a single webhook delivery, failing on any status outside 2xx.
+func postWebhook(ctx context.Context, url, event string, body []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "webhook.post")
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, envDuration("WEBHOOK_TIMEOUT", 5*time.Second))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notes-Event", event)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}